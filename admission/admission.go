@@ -0,0 +1,173 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// default time request waits in the queue for processing slot
+const DefaultQueueTimeout time.Duration = time.Second
+
+// Controller limits number of requests processed at once,
+// requests above the limit wait in the bounded queue, when queue is full or wait times out request is rejected
+type Controller struct {
+	sync.Mutex
+
+	// zero means unlimited
+	max_in_flight		int
+	max_queue		int
+	queue_timeout		time.Duration
+
+	in_flight		int
+
+	// requests waiting for processing slot, released slot is passed to the first waiter
+	waiters			[]chan struct{}
+
+	admitted		uint64
+	rejected		uint64
+	timed_out		uint64
+	canceled		uint64
+}
+
+func NewController() *Controller {
+	return &Controller {
+		queue_timeout:		DefaultQueueTimeout,
+		waiters:		make([]chan struct{}, 0),
+	}
+}
+
+// wake_nolock() passes free processing slots to the waiting requests
+func (c *Controller) wake_nolock() {
+	for len(c.waiters) != 0 && (c.max_in_flight == 0 || c.in_flight < c.max_in_flight) {
+		ch := c.waiters[0]
+		c.waiters = c.waiters[1:]
+
+		c.in_flight++
+		close(ch)
+	}
+}
+
+// Configure() changes limits, requests being processed are not affected,
+// zero @queue_timeout means default timeout
+func (c *Controller) Configure(max_in_flight, max_queue int, queue_timeout time.Duration) {
+	if queue_timeout <= 0 {
+		queue_timeout = DefaultQueueTimeout
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.max_in_flight == max_in_flight && c.max_queue == max_queue && c.queue_timeout == queue_timeout {
+		return
+	}
+
+	c.max_in_flight = max_in_flight
+	c.max_queue = max_queue
+	c.queue_timeout = queue_timeout
+
+	c.wake_nolock()
+}
+
+// Acquire() waits for processing slot, Release() must be called when request completes if there is no error,
+// waiting is aborted with @ctx error if @ctx is done, i.e. client has disconnected
+func (c *Controller) Acquire(ctx context.Context) error {
+	c.Lock()
+
+	if c.max_in_flight == 0 || c.in_flight < c.max_in_flight {
+		c.in_flight++
+		c.admitted++
+		c.Unlock()
+		return nil
+	}
+
+	if len(c.waiters) >= c.max_queue {
+		c.rejected++
+		in_flight := c.in_flight
+		c.Unlock()
+		return fmt.Errorf("overloaded: in-flight: %d, queue is full: %d", in_flight, c.max_queue)
+	}
+
+	ch := make(chan struct{})
+	c.waiters = append(c.waiters, ch)
+	timeout := c.queue_timeout
+	c.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		c.Lock()
+		c.admitted++
+		c.Unlock()
+		return nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	for i, w := range c.waiters {
+		if w == ch {
+			c.waiters = append(c.waiters[:i], c.waiters[i + 1:]...)
+
+			if err := ctx.Err(); err != nil {
+				c.canceled++
+				return err
+			}
+
+			c.timed_out++
+			return fmt.Errorf("overloaded: in-flight: %d, queue timeout %s has expired", c.in_flight, timeout.String())
+		}
+	}
+
+	// slot has been passed to this request right after timeout
+	c.admitted++
+	return nil
+}
+
+// RetryAfter() returns number of seconds rejected client should wait before retrying, it is the queue timeout
+func (c *Controller) RetryAfter() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return int(math.Max(1, math.Ceil(c.queue_timeout.Seconds())))
+}
+
+func (c *Controller) Release() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.in_flight--
+	c.wake_nolock()
+}
+
+func (c *Controller) MarshalJSON() ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	return json.Marshal(&struct {
+		InFlight	int		`json:"in-flight"`
+		Queued		int		`json:"queued"`
+		MaxInFlight	int		`json:"max-in-flight"`
+		MaxQueue	int		`json:"max-queue"`
+		Admitted	uint64		`json:"admitted"`
+		Rejected	uint64		`json:"rejected"`
+		TimedOut	uint64		`json:"timed-out"`
+		Canceled	uint64		`json:"canceled"`
+	} {
+		InFlight:	c.in_flight,
+		Queued:		len(c.waiters),
+		MaxInFlight:	c.max_in_flight,
+		MaxQueue:	c.max_queue,
+		Admitted:	c.admitted,
+		Rejected:	c.rejected,
+		TimedOut:	c.timed_out,
+		Canceled:	c.canceled,
+	})
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"github.com/DemonVex/backrunner/config"
+	"net"
+	"net/http"
+)
+
+// AdminRealm authorizes requests to the administrative handlers,
+// request is allowed if it is signed with admin user token or comes from allowed address
+type AdminRealm struct {
+	users		map[string]string
+
+	// when empty, only loopback clients are allowed
+	allowlist	[]*net.IPNet
+}
+
+func NewAdminRealm(conf *config.ProxyClientConfig) (*AdminRealm, error) {
+	allowlist, err := config.ParseAllowlist(conf.AdminAllowlist)
+	if err != nil {
+		return nil, fmt.Errorf("admin-allowlist: %v", err)
+	}
+
+	return &AdminRealm {
+		users:		conf.AdminUsers,
+		allowlist:	allowlist,
+	}, nil
+}
+
+func (a *AdminRealm) allowed(ip net.IP) bool {
+	if len(a.allowlist) == 0 {
+		return ip.IsLoopback()
+	}
+
+	for _, n := range a.allowlist {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check() returns error if request is not allowed to use administrative handlers
+func (a *AdminRealm) Check(r *http.Request) error {
+	if _, ok := r.Header[AuthHeaderStr]; ok && len(a.users) != 0 {
+		user, recv_auth, _ := GetAuthInfo(r)
+
+		if token, ok := a.users[user]; ok {
+			calc_auth, err := GenerateSignature(token, r.Method, r.URL, r.Header)
+			if err != nil {
+				return fmt.Errorf("admin: user: %s, hmac generation failed", user)
+			}
+
+			if !hmac.Equal([]byte(recv_auth), []byte(calc_auth)) {
+				return fmt.Errorf("admin: user: %s, hmac mismatch", user)
+			}
+
+			return nil
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !a.allowed(ip) {
+		return fmt.Errorf("admin: client '%s' is not allowed to use administrative handlers", host)
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"github.com/DemonVex/backrunner/config"
+	"net/http/httptest"
+	"testing"
+)
+
+func test_admin_realm(t *testing.T, allowlist []string) *AdminRealm {
+	a, err := NewAdminRealm(&config.ProxyClientConfig {
+		AdminAllowlist:	allowlist,
+		AdminUsers:	map[string]string {
+			"admin":	"admin-token",
+		},
+	})
+	if err != nil {
+		t.Fatalf("allowlist %v: unexpected error: %v", allowlist, err)
+	}
+
+	return a
+}
+
+func TestAdminRealmAllowlist(t *testing.T) {
+	tests := []struct {
+		allowlist	[]string
+		remote		string
+		allowed		bool
+	} {
+		// only loopback clients are allowed when allowlist is empty
+		{nil, "127.0.0.1:1234", true},
+		{nil, "[::1]:1234", true},
+		{nil, "10.0.0.1:1234", false},
+
+		{[]string{"10.0.0.0/8"}, "10.1.2.3:1234", true},
+		{[]string{"10.0.0.0/8"}, "11.1.2.3:1234", false},
+		{[]string{"10.0.0.0/8"}, "127.0.0.1:1234", false},
+		{[]string{"192.168.1.1"}, "192.168.1.1:1234", true},
+		{[]string{"192.168.1.1"}, "192.168.1.2:1234", false},
+		{[]string{"2001:db8::/32", "192.168.1.1"}, "[2001:db8::1]:1234", true},
+		{[]string{"2001:db8::/32"}, "[2001:db9::1]:1234", false},
+
+		// address without port
+		{[]string{"192.168.1.1"}, "192.168.1.1", true},
+		{[]string{"192.168.1.1"}, "garbage", false},
+	}
+
+	for _, test := range tests {
+		a := test_admin_realm(t, test.allowlist)
+
+		req := httptest.NewRequest("POST", "/defrag/pause", nil)
+		req.RemoteAddr = test.remote
+
+		err := a.Check(req)
+		if test.allowed && err != nil {
+			t.Errorf("allowlist %v, client %s: unexpected error: %v", test.allowlist, test.remote, err)
+		}
+		if !test.allowed && err == nil {
+			t.Errorf("allowlist %v, client %s has been allowed", test.allowlist, test.remote)
+		}
+	}
+}
+
+func TestAdminRealmInvalidAllowlist(t *testing.T) {
+	for _, allowlist := range [][]string{{"10.0.0.0/33"}, {"host"}, {"10.0.0.1", "300.0.0.1"}} {
+		_, err := NewAdminRealm(&config.ProxyClientConfig {
+			AdminAllowlist:	allowlist,
+		})
+		if err == nil {
+			t.Errorf("allowlist %v has been accepted", allowlist)
+		}
+	}
+}
+
+func TestAdminRealmUser(t *testing.T) {
+	a := test_admin_realm(t, []string{"10.0.0.0/8"})
+
+	sign := func(user, token string) string {
+		req := httptest.NewRequest("POST", "/defrag/pause", nil)
+		auth, err := GenerateSignature(token, req.Method, req.URL, req.Header)
+		if err != nil {
+			t.Fatalf("could not generate signature: %v", err)
+		}
+
+		return "riftv1 " + user + ":" + auth
+	}
+
+	tests := []struct {
+		auth		string
+		remote		string
+		allowed		bool
+	} {
+		// signed admin request is allowed from any address
+		{sign("admin", "admin-token"), "11.0.0.1:1234", true},
+		{sign("admin", "wrong-token"), "11.0.0.1:1234", false},
+
+		// signature mismatch is not hidden by allowed address
+		{sign("admin", "wrong-token"), "10.0.0.1:1234", false},
+
+		// unknown users are checked against allowlist
+		{sign("user", "admin-token"), "11.0.0.1:1234", false},
+		{sign("user", "admin-token"), "10.0.0.1:1234", true},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/defrag/pause", nil)
+		req.RemoteAddr = test.remote
+		req.Header.Set(AuthHeaderStr, test.auth)
+
+		err := a.Check(req)
+		if test.allowed && err != nil {
+			t.Errorf("auth '%s', client %s: unexpected error: %v", test.auth, test.remote, err)
+		}
+		if !test.allowed && err == nil {
+			t.Errorf("auth '%s', client %s has been allowed", test.auth, test.remote)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// client certificate fields which can be used as bucket ACL user names
+const (
+	CertUserCommonName string	= "cn"
+	CertUserDNS string		= "dns"
+	CertUserEmail string		= "email"
+	CertUserURI string		= "uri"
+	CertUserSubject string		= "subject"
+)
+
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: there are no PEM encoded certificates", file)
+	}
+
+	return pool, nil
+}
+
+// ClientTLSConfig() returns server TLS config which verifies client certificates against CA bundle in @ca_file,
+// when @required is false, clients without certificates are allowed to connect
+func ClientTLSConfig(ca_file string, required bool) (*tls.Config, error) {
+	pool, err := LoadCertPool(ca_file)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config {
+		ClientCAs:	pool,
+		ClientAuth:	tls.VerifyClientCertIfGiven,
+	}
+
+	if required {
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return conf, nil
+}
+
+// ClientCertNames() returns candidate user names from the verified client certificate,
+// it returns nil if connection is not TLS or there is no verified certificate
+func ClientCertNames(state *tls.ConnectionState, source string) []string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := state.VerifiedChains[0][0]
+
+	switch source {
+	case CertUserDNS:
+		return cert.DNSNames
+	case CertUserEmail:
+		return cert.EmailAddresses
+	case CertUserURI:
+		names := make([]string, 0, len(cert.URIs))
+		for _, u := range cert.URIs {
+			names = append(names, u.String())
+		}
+		return names
+	case CertUserSubject:
+		return []string{cert.Subject.String()}
+	}
+
+	if len(cert.Subject.CommonName) == 0 {
+		return nil
+	}
+
+	return []string{cert.Subject.CommonName}
+}
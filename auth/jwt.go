@@ -0,0 +1,365 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/DemonVex/backrunner/config"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	BearerScheme string		= "Bearer"
+
+	DefaultJWTUserClaim string	= "sub"
+	DefaultJWTFlagsClaim string	= "flags"
+)
+
+// JWT flag names, values match bucket ACL flags
+var JWTFlagNames = map[string]uint64 {
+	"write":	2,
+	"admin":	4,
+}
+
+type jwt_key struct {
+	id		string
+	alg		string
+
+	// []byte for HS256, *rsa.PublicKey for RS256, *ecdsa.PublicKey for ES256
+	key		interface{}
+}
+
+type JWTVerifier struct {
+	keys		[]*jwt_key
+
+	issuer		string
+	audience	string
+	user_claim	string
+	flags_claim	string
+	leeway		int64
+	max_lifetime	int64
+}
+
+// JWTIdentity is a bucket ACL user and flags extracted from the verified token
+type JWTIdentity struct {
+	User		string
+
+	// when @HasFlags is false, token does not limit user's ACL flags
+	Flags		uint64
+	HasFlags	bool
+}
+
+func load_public_key(file string) (interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: there is no PEM data", file)
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+
+	return nil, fmt.Errorf("%s: unsupported PEM block type '%s'", file, block.Type)
+}
+
+func load_jwt_key(k *config.JWTKey) (*jwt_key, error) {
+	key := &jwt_key {
+		id:		k.ID,
+		alg:		k.Alg,
+	}
+
+	switch k.Alg {
+	case "HS256":
+		data, err := ioutil.ReadFile(k.File)
+		if err != nil {
+			return nil, err
+		}
+
+		secret := []byte(strings.TrimSpace(string(data)))
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("%s: empty HS256 secret", k.File)
+		}
+		key.key = secret
+
+	case "RS256":
+		pub, err := load_public_key(k.File)
+		if err != nil {
+			return nil, err
+		}
+
+		rsa_key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an RSA public key", k.File)
+		}
+		key.key = rsa_key
+
+	case "ES256":
+		pub, err := load_public_key(k.File)
+		if err != nil {
+			return nil, err
+		}
+
+		ec_key, ok := pub.(*ecdsa.PublicKey)
+		if !ok || ec_key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s: not an ECDSA P-256 public key", k.File)
+		}
+		key.key = ec_key
+
+	default:
+		return nil, fmt.Errorf("unsupported algorithm '%s'", k.Alg)
+	}
+
+	return key, nil
+}
+
+// NewJWTVerifier() loads all configured keys, it returns nil verifier if there are no keys
+func NewJWTVerifier(conf *config.JWTConfig) (*JWTVerifier, error) {
+	if len(conf.Keys) == 0 {
+		return nil, nil
+	}
+
+	v := &JWTVerifier {
+		keys:		make([]*jwt_key, 0, len(conf.Keys)),
+		issuer:		conf.Issuer,
+		audience:	conf.Audience,
+		user_claim:	conf.UserClaim,
+		flags_claim:	conf.FlagsClaim,
+		leeway:		int64(conf.Leeway),
+		max_lifetime:	int64(conf.MaxLifetime),
+	}
+
+	if len(v.user_claim) == 0 {
+		v.user_claim = DefaultJWTUserClaim
+	}
+	if len(v.flags_claim) == 0 {
+		v.flags_claim = DefaultJWTFlagsClaim
+	}
+
+	for i := range conf.Keys {
+		key, err := load_jwt_key(&conf.Keys[i])
+		if err != nil {
+			return nil, fmt.Errorf("jwt: key '%s': %v", conf.Keys[i].ID, err)
+		}
+
+		v.keys = append(v.keys, key)
+	}
+
+	return v, nil
+}
+
+// GetBearerToken() returns token from 'Authorization: Bearer <token>' header
+func GetBearerToken(r *http.Request) (token string, ok bool) {
+	auth_headers, ok := r.Header[AuthHeaderStr]
+	if !ok {
+		return "", false
+	}
+
+	auth_data := strings.SplitN(auth_headers[0], " ", 2)
+	if len(auth_data) != 2 || auth_data[0] != BearerScheme {
+		return "", false
+	}
+
+	return strings.TrimSpace(auth_data[1]), true
+}
+
+func verify_signature(key *jwt_key, signed, sig []byte) bool {
+	sum := sha256.Sum256(signed)
+
+	switch k := key.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil
+
+	case *ecdsa.PublicKey:
+		// JWS ES256 signature is a concatenation of 32-byte R and S
+		if len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, sum[:], r, s)
+	}
+
+	return false
+}
+
+func claim_int(claims map[string]interface{}, name string) (int64, bool) {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return 0, false
+	}
+
+	return int64(v), true
+}
+
+func (v *JWTVerifier) check_audience(claims map[string]interface{}) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == v.audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == v.audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (v *JWTVerifier) extract_flags(claims map[string]interface{}, id *JWTIdentity) error {
+	raw, ok := claims[v.flags_claim]
+	if !ok {
+		return nil
+	}
+
+	id.HasFlags = true
+
+	switch flags := raw.(type) {
+	case float64:
+		id.Flags = uint64(flags)
+	case []interface{}:
+		for _, f := range flags {
+			name, ok := f.(string)
+			if !ok {
+				return fmt.Errorf("claim '%s': flag '%v' is not a string", v.flags_claim, f)
+			}
+
+			flag, ok := JWTFlagNames[name]
+			if !ok {
+				return fmt.Errorf("claim '%s': unknown flag '%s'", v.flags_claim, name)
+			}
+
+			id.Flags |= flag
+		}
+	default:
+		return fmt.Errorf("claim '%s' must be either number or list of flag names", v.flags_claim)
+	}
+
+	return nil
+}
+
+// Verify() checks token signature and claims and returns identity it grants
+func (v *JWTVerifier) Verify(token string, now time.Time) (*JWTIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("jwt: malformed token")
+	}
+
+	header_data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: malformed header: %v", err)
+	}
+
+	header := struct {
+		Alg	string	`json:"alg"`
+		Kid	string	`json:"kid"`
+	} {}
+	err = json.Unmarshal(header_data, &header)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: malformed header: %v", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: malformed signature: %v", err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range v.keys {
+		// algorithm is always taken from the key, not from the token, 'none' is never accepted
+		if key.alg != header.Alg || key.id != header.Kid {
+			continue
+		}
+
+		if verify_signature(key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, fmt.Errorf("jwt: signature verification failed, alg: '%s', kid: '%s'", header.Alg, header.Kid)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: malformed payload: %v", err)
+	}
+
+	claims := make(map[string]interface{})
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: malformed payload: %v", err)
+	}
+
+	// tokens without expiration time would be valid forever
+	ts := now.Unix()
+	exp, ok := claim_int(claims, "exp")
+	if !ok {
+		return nil, fmt.Errorf("jwt: there is no 'exp' claim")
+	}
+	if ts > exp + v.leeway {
+		return nil, fmt.Errorf("jwt: token has expired at %s", time.Unix(exp, 0).String())
+	}
+	if v.max_lifetime > 0 && exp - ts > v.max_lifetime + v.leeway {
+		return nil, fmt.Errorf("jwt: token expires at %s, it is more than %d seconds in the future",
+			time.Unix(exp, 0).String(), v.max_lifetime)
+	}
+	if nbf, ok := claim_int(claims, "nbf"); ok && ts < nbf - v.leeway {
+		return nil, fmt.Errorf("jwt: token is not valid before %s", time.Unix(nbf, 0).String())
+	}
+
+	if len(v.issuer) != 0 {
+		if iss, _ := claims["iss"].(string); iss != v.issuer {
+			return nil, fmt.Errorf("jwt: invalid issuer '%s'", iss)
+		}
+	}
+	if len(v.audience) != 0 && !v.check_audience(claims) {
+		return nil, fmt.Errorf("jwt: token is not issued for audience '%s'", v.audience)
+	}
+
+	id := &JWTIdentity {}
+	id.User, _ = claims[v.user_claim].(string)
+	if len(id.User) == 0 {
+		return nil, fmt.Errorf("jwt: there is no user claim '%s'", v.user_claim)
+	}
+
+	err = v.extract_flags(claims, id)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: %v", err)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var test_secret = []byte("test-secret")
+
+func test_verifier() *JWTVerifier {
+	return &JWTVerifier {
+		keys:		[]*jwt_key {
+			&jwt_key {
+				id:	"k1",
+				alg:	"HS256",
+				key:	test_secret,
+			},
+		},
+		user_claim:	DefaultJWTUserClaim,
+		flags_claim:	DefaultJWTFlagsClaim,
+		leeway:		10,
+	}
+}
+
+func test_segment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("could not marshal %v: %v", v, err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// test_token() returns token signed with @secret, @alg is only written into the header
+func test_token(t *testing.T, alg string, secret []byte, claims map[string]interface{}) string {
+	header := map[string]string {
+		"alg":	alg,
+		"kid":	"k1",
+	}
+
+	signed := test_segment(t, header) + "." + test_segment(t, claims)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTVerify(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	ts := now.Unix()
+
+	tests := []struct {
+		name		string
+		alg		string
+		secret		[]byte
+		claims		map[string]interface{}
+		max_lifetime	int64
+		ok		bool
+	} {
+		{"valid", "HS256", test_secret, map[string]interface{}{"sub": "user", "exp": ts + 60}, 0, true},
+		{"expired", "HS256", test_secret, map[string]interface{}{"sub": "user", "exp": ts - 60}, 0, false},
+		{"expired within leeway", "HS256", test_secret, map[string]interface{}{"sub": "user", "exp": ts - 5}, 0, true},
+		{"no exp", "HS256", test_secret, map[string]interface{}{"sub": "user"}, 0, false},
+		{"not yet valid", "HS256", test_secret, map[string]interface{}{"sub": "user", "exp": ts + 600, "nbf": ts + 60}, 0, false},
+		{"nbf within leeway", "HS256", test_secret, map[string]interface{}{"sub": "user", "exp": ts + 600, "nbf": ts + 5}, 0, true},
+		{"lifetime exceeded", "HS256", test_secret, map[string]interface{}{"sub": "user", "exp": ts + 3600}, 600, false},
+		{"lifetime within limit", "HS256", test_secret, map[string]interface{}{"sub": "user", "exp": ts + 300}, 600, true},
+		{"alg none", "none", test_secret, map[string]interface{}{"sub": "user", "exp": ts + 60}, 0, false},
+		{"alg mismatch", "RS256", test_secret, map[string]interface{}{"sub": "user", "exp": ts + 60}, 0, false},
+		{"wrong secret", "HS256", []byte("other-secret"), map[string]interface{}{"sub": "user", "exp": ts + 60}, 0, false},
+		{"no user", "HS256", test_secret, map[string]interface{}{"exp": ts + 60}, 0, false},
+	}
+
+	for _, test := range tests {
+		v := test_verifier()
+		v.max_lifetime = test.max_lifetime
+
+		_, err := v.Verify(test_token(t, test.alg, test.secret, test.claims), now)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: token has been accepted", test.name)
+		}
+	}
+}
+
+func TestJWTVerifyFlags(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	v := test_verifier()
+
+	token := test_token(t, "HS256", test_secret, map[string]interface{} {
+		"sub":		"user",
+		"exp":		now.Unix() + 60,
+		"flags":	[]string{"write", "admin"},
+	})
+
+	id, err := v.Verify(token, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id.User != "user" || !id.HasFlags || id.Flags != JWTFlagNames["write"] | JWTFlagNames["admin"] {
+		t.Fatalf("invalid identity: %+v", id)
+	}
+
+	token = test_token(t, "HS256", test_secret, map[string]interface{} {
+		"sub":		"user",
+		"exp":		now.Unix() + 60,
+		"flags":	[]string{"root"},
+	})
+
+	_, err = v.Verify(token, now)
+	if err == nil || !strings.Contains(err.Error(), "unknown flag") {
+		t.Fatalf("unknown flag has been accepted, error: %v", err)
+	}
+}
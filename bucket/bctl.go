@@ -1,9 +1,11 @@
 package bucket
 
 import (
+	"context"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/DemonVex/backrunner/auth"
 	"github.com/DemonVex/backrunner/config"
 	"github.com/DemonVex/backrunner/errors"
 	"github.com/DemonVex/backrunner/etransport"
@@ -13,7 +15,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	//"math"
+	"math"
 	"math/rand"
 	"net/http"
 	"os"
@@ -21,6 +23,7 @@ import (
 	"path"
 	"runtime"
 	"runtime/pprof"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -40,7 +43,7 @@ const (
 	// this is randomly selected error gain for buckets where upload has failed
 	BucketWriteErrorPain float64	= PainNoFreeSpaceHard / 2
 
-	// pain for group without statistics
+	// pain for group without statistics or with statistics older than max stat age
 	PainNoStats float64		= PainNoFreeSpaceHard / 2
 
 	// pain for group where statistics contains error field
@@ -61,6 +64,9 @@ type BucketCtl struct {
 	proxy_config_path	string
 	Conf			*config.ProxyConfig
 
+	// authorizes administrative handlers, it is built from @Conf
+	AdminRealm		*auth.AdminRealm
+
 	signals			chan os.Signal
 
 	BucketTimer		*time.Timer
@@ -69,12 +75,28 @@ type BucketCtl struct {
 	// time when previous statistics update has been performed
 	StatTime		time.Time
 
+	// the last failed statistics update, it is cleared by successful update
+	StatError		string
+
+	// number of groups in the last statistics update
+	StatGroups		int
+
+	// time of the last statistics update which has contained given address+backend
+	BackendStatTime		map[elliptics.AddressBackend]time.Time
+
 	// time when backrunner proxy started
 	StartTime		time.Time
 
 	// time when the last time config update was done
 	ConfigTime		time.Time
 
+	// the last rejected config reload, @Conf is the last known good config in this case
+	ConfigError		string
+	ConfigErrorTime		time.Time
+
+	// restart-only changes of the config file which are not in effect, they are logged once
+	restart_pending		string
+
 	// time when previous defragmentation scan was performed
 	DefragTime		time.Time
 
@@ -86,6 +108,19 @@ type BucketCtl struct {
 	// buckets used by clients directly, i.e. when client explicitly says
 	// he wants to work with bucket named 'X'
 	BackBucket		[]*Bucket
+
+	// write PID controller states, they survive statistics updates and are saved into metadata groups
+	PID			*PIDStore
+
+	// read latency and errors of every address+backend
+	Health			*HealthStore
+
+	// defragmentation scheduler state and audit log
+	Defrag			*DefragCtl
+
+	// proxy request rate, new defragmentation is postponed when it is too high,
+	// it is set by NewBucketCtl() and must not be changed later
+	RequestRate		RateFunc
 }
 
 func (bctl *BucketCtl) AllBuckets() []*Bucket {
@@ -125,27 +160,88 @@ func (bctl *BucketCtl) FindBucket(name string) (bucket *Bucket, err error) {
 	return bucket, nil
 }
 
+// stat_max_age() returns age after which statistics is stale, @bctl must be locked
+func (bctl *BucketCtl) stat_max_age() time.Duration {
+	if bctl.Conf.Proxy.StatMaxAge > 0 {
+		return time.Duration(bctl.Conf.Proxy.StatMaxAge) * time.Second
+	}
+
+	return 3 * time.Duration(bctl.Conf.Proxy.BucketStatUpdateInterval) * time.Second
+}
+
+// check_stat_age() returns error if statistics of the group or address+backend is older than @max_age,
+// @bctl must be locked
+func (bctl *BucketCtl) check_stat_age(b *Bucket, group_id uint32, st *elliptics.StatBackend, now time.Time, max_age time.Duration) error {
+	if age := now.Sub(b.GroupTime[group_id]); age > max_age {
+		return fmt.Errorf("group statistics is stale, age: %s, max age: %s", age.String(), max_age.String())
+	}
+
+	if t, ok := bctl.BackendStatTime[st.Ab]; ok {
+		if age := now.Sub(t); age > max_age {
+			return fmt.Errorf("backend statistics is stale, age: %s, max age: %s", age.String(), max_age.String())
+		}
+	}
+
+	return nil
+}
+
+// address+backend which has not been present in statistics for this long is forgotten
+const BackendStatTimeMaxAge time.Duration = 24 * time.Hour
+
 func (bctl *BucketCtl) BucketStatUpdateNolock(stat *elliptics.DnetStat) (err error) {
 	bctl.StatTime = stat.Time
+	bctl.StatGroups = len(stat.Group)
+	bctl.StatError = ""
+
+	for _, sg := range stat.Group {
+		for ab := range sg.Ab {
+			bctl.BackendStatTime[ab] = stat.Time
+		}
+	}
+	for ab, t := range bctl.BackendStatTime {
+		if stat.Time.Sub(t) > BackendStatTimeMaxAge {
+			delete(bctl.BackendStatTime, ab)
+		}
+	}
 
+	max_age := bctl.stat_max_age()
 	for _, b := range bctl.AllBuckets() {
 		for _, group := range b.Meta.Groups {
 			sg, ok := stat.Group[group]
 			if ok {
 				b.Group[group] = sg
+				b.GroupTime[group] = stat.Time
+				bctl.PID.Apply(sg, bctl.pid_state_max_age())
+			} else if _, ok = b.Group[group]; ok {
+				age := stat.Time.Sub(b.GroupTime[group])
+				stale := ""
+				if age > max_age {
+					stale = ", statistics is stale, group is not used for uploads"
+				}
+
+				log.Printf("bucket-stat-update: bucket: %s, group: %d: there is no bucket stat, " +
+					"using old values, age: %s, max age: %s%s",
+					b.Name, group, age.String(), max_age.String(), stale)
 			} else {
-				log.Printf("bucket-stat-update: bucket: %s, group: %d: there is no bucket stat, using old values (if any)",
+				log.Printf("bucket-stat-update: bucket: %s, group: %d: there is no bucket stat",
 					b.Name, group)
 			}
 		}
 	}
 
+	if bctl.Defrag.Track(stat) {
+		go bctl.SaveDefragHistory()
+	}
+
 	return
 }
 
 func (bctl *BucketCtl) BucketStatUpdate() (err error) {
 	stat, err := bctl.e.Stat()
 	if err != nil {
+		bctl.Lock()
+		bctl.StatError = err.Error()
+		bctl.Unlock()
 		return err
 	}
 
@@ -169,177 +265,58 @@ func FreeSpaceRatio(st *elliptics.StatBackend, content_length uint64) float64 {
 	return free_space_rate
 }
 
-func (bctl *BucketCtl) GetBucket(key string, req *http.Request) (bucket *Bucket) {
-	s, err := bctl.e.MetadataSession()
-	if err != nil {
-		err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
-			fmt.Sprintf("get-bucket: could not create metadata session: %v", err))
-		return bctl.Bucket[rand.Intn(len(bctl.Bucket))]
-	}
-	defer s.Delete()
-
-	type bucket_stat struct {
-		Bucket        *Bucket
-		SuccessGroups []uint32
-		ErrorGroups   []uint32
-		Pain          float64
-		Range         float64
-
-		pains         []float64
-		free_rates    []float64
-
-		abs           []string
-	}
-
-	stat := make([]*bucket_stat, 0)
-	failed := make([]*bucket_stat, 0)
-	func() {
-		bctl.RLock()
-		defer bctl.RUnlock()
-
-		for _, b := range bctl.Bucket {
-			bs := &bucket_stat{
-				Bucket:        b,
-				SuccessGroups:    make([]uint32, 0),
-				ErrorGroups:    make([]uint32, 0),
-				Pain:        0.0,
-				Range:        0.0,
+// pain_params() returns pain constants and free space ratios of the current config
+func (bctl *BucketCtl) pain_params() *PainParams {
+	return NewPainParams(bctl.Conf.Proxy.FreeSpaceRatioSoft, bctl.Conf.Proxy.FreeSpaceRatioHard)
+}
 
-				pains:        make([]float64, 0, len(b.Group)),
-				free_rates:    make([]float64, 0, len(b.Group)),
+// bucket_pains() calculates pains of all writable buckets for upload of @size bytes with given key
+func (bctl *BucketCtl) bucket_pains(s *elliptics.Session, key string, size uint64, params *PainParams) []*BucketPain {
+	bctl.RLock()
+	defer bctl.RUnlock()
 
-			}
+	now := time.Now()
+	max_age := bctl.stat_max_age()
 
-			s.SetNamespace(b.Name)
+	pains := make([]*BucketPain, 0, len(bctl.Bucket))
+	for _, b := range bctl.Bucket {
+		s.SetNamespace(b.Name)
 
-			for group_id, sg := range b.Group {
+		bp := NewBucketPain(b, size, params,
+			func(group_id uint32, sg *elliptics.StatGroup) (*elliptics.StatBackend, error) {
 				st, err := sg.FindStatBackendKey(s, key, group_id)
 				if err != nil {
-					// there is no statistics for given address+backend, which should host our data
-					// do not allow to write into the bucket which contains given address+backend
-
-					bs.ErrorGroups = append(bs.ErrorGroups, group_id)
-
-					bs.Pain += PainNoStats
-					continue
-				}
-
-				bs.abs = append(bs.abs, st.Ab.String())
-
-				if st.RO {
-					bs.ErrorGroups = append(bs.ErrorGroups, group_id)
-
-					bs.Pain += PainStatRO
-					continue
-				}
-
-				if st.Error.Code != 0 {
-					bs.ErrorGroups = append(bs.ErrorGroups, group_id)
-
-					bs.Pain += PainStatError
-					continue
+					return nil, err
 				}
 
-				// this is an empty stat structure
-				if st.VFS.TotalSizeLimit == 0 || st.VFS.Total == 0 {
-					bs.ErrorGroups = append(bs.ErrorGroups, group_id)
-
-					bs.Pain += PainNoStats
-					continue
-				}
-
-				free_space_rate := FreeSpaceRatio(st, uint64(req.ContentLength))
-				if free_space_rate <= bctl.Conf.Proxy.FreeSpaceRatioHard {
-					bs.ErrorGroups = append(bs.ErrorGroups, group_id)
-
-					bs.Pain += PainNoFreeSpaceHard
-				} else if free_space_rate <= bctl.Conf.Proxy.FreeSpaceRatioSoft {
-					bs.ErrorGroups = append(bs.ErrorGroups, group_id)
-
-					free_space_pain := 1000.0 / (free_space_rate - bctl.Conf.Proxy.FreeSpaceRatioHard)
-					bs.Pain += PainNoFreeSpaceSoft + free_space_pain * 5
-				} else {
-					bs.SuccessGroups = append(bs.SuccessGroups, group_id)
-
-					free_space_pain := 1000.0 / (free_space_rate - bctl.Conf.Proxy.FreeSpaceRatioSoft)
-					if free_space_pain >= PainNoFreeSpaceSoft {
-						free_space_pain = PainNoFreeSpaceSoft * 0.8
-					}
-
-					bs.Pain += free_space_pain
-				}
-
-				pp := st.PIDPain()
-
-				bs.Pain += pp
-				bs.pains = append(bs.pains, pp)
-				bs.free_rates = append(bs.free_rates, free_space_rate)
-			}
-
-			total_groups := len(bs.SuccessGroups) + len(bs.ErrorGroups)
-			diff := 0
-			if len(b.Meta.Groups) > total_groups {
-				diff += len(b.Meta.Groups) - total_groups
-			}
-
-			bs.Pain += float64(diff) * PainNoGroup
-
-			// calculate discrepancy pain:
-			// run over all address+backends in every group in given bucket,
-			// sum up number of live records
-			// set discrepancy as a maximum difference between number of records among all groups
-			var min_records uint64 = 1 << 31 - 1
-			var max_records uint64 = 0
-
-			records := make([]uint64, 0)
-			for _, sg := range b.Group {
-				var r uint64 = 0
-
-				for _, sb := range sg.Ab {
-					r += sb.VFS.RecordsTotal - sb.VFS.RecordsRemoved
-				}
-
-				records = append(records, r)
-			}
-
-			for _, r := range records {
-				if r < min_records {
-					min_records = r
-				}
-
-				if r > max_records {
-					max_records = r
-				}
-			}
-			bs.Pain += float64(max_records - min_records) * PainDiscrepancy
+				return st, bctl.check_stat_age(b, group_id, st, now, max_age)
+			})
 
+		pains = append(pains, bp)
+	}
 
-			// do not even consider buckets without free space even in one group
-			if bs.Pain >= PainNoFreeSpaceHard {
-				//log.Printf("find-bucket: url: %s, bucket: %s, content-length: %d, groups: %v, success-groups: %v, error-groups: %v, pain: %f, pains: %v, free_rates: %v: pain is higher than HARD limit\n",
-				//	req.URL.String(), b.Name, req.ContentLength, b.Meta.Groups, bs.SuccessGroups, bs.ErrorGroups, bs.Pain,
-				//	bs.pains, bs.free_rates)
-				failed = append(failed, bs)
-				continue
-			}
+	return pains
+}
 
-			if bs.Pain != 0 {
-				bs.Range = 1.0 / bs.Pain
-			} else {
-				bs.Range = 1.0
-			}
+func (bctl *BucketCtl) GetBucket(key string, req *http.Request) (bucket *Bucket) {
+	s, err := bctl.e.MetadataSession()
+	if err != nil {
+		err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
+			fmt.Sprintf("get-bucket: could not create metadata session: %v", err))
+		return bctl.Bucket[rand.Intn(len(bctl.Bucket))]
+	}
+	defer s.Delete()
 
-			stat = append(stat, bs)
-		}
-	} ()
+	params := bctl.pain_params()
+	pains := bctl.bucket_pains(s, key, uint64(req.ContentLength), params)
+	stat := SelectionCandidates(pains, params)
 
 	// there are no buckets suitable for this request
 	// either there is no space in either bucket, or there are no buckets at all
 	if len(stat) == 0 {
 		str := make([]string, 0)
-		for _, bs := range failed {
-			str = append(str, fmt.Sprintf("{bucket: %s, success-groups: %v, error-groups: %v, groups: %v, abs: %v, pain: %f, free-rates: %v}",
-				bs.Bucket.Name, bs.SuccessGroups, bs.ErrorGroups, bs.Bucket.Meta.Groups, bs.abs, bs.Pain, bs.free_rates))
+		for _, bp := range pains {
+			str = append(str, bp.String())
 		}
 
 		log.Printf("find-bucket: url: %s, content-length: %d: there are no suitable buckets: %v",
@@ -347,33 +324,10 @@ func (bctl *BucketCtl) GetBucket(key string, req *http.Request) (bucket *Bucket)
 		return nil
 	}
 
-	// get rid of buckets without free space if we do have other buckets
-	ok_buckets := 0
-	nospace_buckets := 0
-	for _, bs := range stat {
-		if bs.Pain < PainNoFreeSpaceSoft {
-			ok_buckets++
-		} else {
-			nospace_buckets++
-		}
-	}
-
-	if nospace_buckets != 0 && ok_buckets != 0 {
-		tmp := make([]*bucket_stat, 0)
-		for _, bs := range stat {
-			if bs.Pain < PainNoFreeSpaceSoft {
-				tmp = append(tmp, bs)
-			}
-		}
-
-		stat = tmp
-	}
-
 	str := make([]string, 0)
 	show_num := 0
-	for _, bs := range stat {
-		str = append(str, fmt.Sprintf("{bucket: %s, success-groups: %v, error-groups: %v, groups: %v, abs: %v, pain: %f, free-rates: %v}",
-			bs.Bucket.Name, bs.SuccessGroups, bs.ErrorGroups, bs.Bucket.Meta.Groups, bs.abs, bs.Pain, bs.free_rates))
+	for _, bp := range stat {
+		str = append(str, bp.String())
 
 		if show_num >= 5 {
 			break
@@ -383,44 +337,60 @@ func (bctl *BucketCtl) GetBucket(key string, req *http.Request) (bucket *Bucket)
 	log.Printf("find-bucket: url: %s, content-length: %d, buckets: %d, showing top %d: %v",
 		req.URL.String(), req.ContentLength, len(stat), len(str), str)
 
-	var sum int64 = 0
-	for {
-		sum = 0
-		var multiple int64 = 10
+	bp := SelectBucket(stat)
+	if bp == nil {
+		return nil
+	}
 
-		for _, bs := range stat {
-			sum += int64(bs.Range)
-		}
+	log.Printf("find-bucket: url: %s, content-length: %d, selected bucket: %s\n",
+		req.URL.String(), req.ContentLength, bp.String())
+	return bp.Bucket
+}
 
-		if sum >= multiple {
-			break
-		} else {
-			for _, bs := range stat {
-				bs.Range *= float64(multiple)
-			}
-		}
+type SelectExplain struct {
+	Key			string
+	Size			uint64
+	FreeSpaceRatioSoft	float64
+	FreeSpaceRatioHard	float64
+
+	// number of buckets which can be selected for this upload
+	Candidates		int
+
+	// all writable buckets, excluded ones have non-empty @Excluded field
+	Buckets			[]*BucketPain
+}
+
+// SelectExplain() runs the same bucket selection logic as the upload without bucket name,
+// but instead of selecting a bucket it returns pains and selection probabilities of all writable buckets
+func (bctl *BucketCtl) SelectExplain(key string, size uint64, req *http.Request) (reply *SelectExplain, err error) {
+	s, err := bctl.e.MetadataSession()
+	if err != nil {
+		err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
+			fmt.Sprintf("select-explain: could not create metadata session: %v", err))
+		return
 	}
+	defer s.Delete()
 
-	r := rand.Int63n(int64(sum))
-	for _, bs := range stat {
-		r -= int64(bs.Range)
-		if r <= 0 {
-			log.Printf("find-bucket: url: %s, selected bucket: %s, content-length: %d, groups: %v, success-groups: %v, error-groups: %v, pain: %f, pains: %v, free_rates: %v\n",
-				req.URL.String(), bs.Bucket.Name, req.ContentLength,
-				bs.Bucket.Meta.Groups, bs.SuccessGroups, bs.ErrorGroups,
-				bs.Pain, bs.pains, bs.free_rates)
-			return bs.Bucket
-		}
+	params := bctl.pain_params()
+	pains := bctl.bucket_pains(s, key, size, params)
+	stat := SelectionCandidates(pains, params)
+
+	reply = &SelectExplain {
+		Key:			key,
+		Size:			size,
+		FreeSpaceRatioSoft:	bctl.Conf.Proxy.FreeSpaceRatioSoft,
+		FreeSpaceRatioHard:	bctl.Conf.Proxy.FreeSpaceRatioHard,
+		Candidates:		len(stat),
+		Buckets:		pains,
 	}
 
-	return nil
+	return
 }
 
-func (bctl *BucketCtl) bucket_upload(bucket *Bucket, key string, req *http.Request) (reply *reply.LookupResult, err error) {
-	err = bucket.check_auth(req, BucketAuthWrite)
+func (bctl *BucketCtl) bucket_upload(ctx context.Context, bucket *Bucket, key string, req *http.Request) (reply *reply.LookupResult, err error) {
+	user, err := bucket.check_auth(req, BucketAuthWrite)
 	if err != nil {
-		err = errors.NewKeyError(req.URL.String(), errors.ErrorStatus(err),
-			fmt.Sprintf("upload: %s", errors.ErrorData(err)))
+		err = errors.PrefixKeyError(err, req.URL.String(), "upload")
 		return
 	}
 
@@ -444,20 +414,27 @@ func (bctl *BucketCtl) bucket_upload(bucket *Bucket, key string, req *http.Reque
 		return
 	}
 
-	s, err := bctl.e.DataSession(req)
+	s, err := bctl.e.DataSession(ctx, req)
 	if err != nil {
-		err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
-			fmt.Sprintf("upload: could not create data session: %v", err))
+		err = bctl.session_error(ctx, req, "upload", err)
 		return
 	}
-	defer s.Delete()
+	so := &session_owner {
+		s:		s,
+	}
+	defer so.Delete()
 
 	s.SetFilter(elliptics.SessionFilterAll)
 	s.SetNamespace(bucket.Name)
 	s.SetGroups(bucket.Meta.Groups)
-	s.SetTimeout(100)
 	s.SetIOflags(elliptics.IOflag(bctl.Conf.Proxy.WriterIOFlags))
 
+	ctx, cancel, _, err := bctl.session_timeout(ctx, s, req, bctl.op_timeout(bucket, TimeoutWrite))
+	defer cancel()
+	if err != nil {
+		return
+	}
+
 	log.Printf("upload-trace-id: %x: url: %s, bucket: %s, key: %s, id: %s\n",
 		s.GetTraceID(), req.URL.String(), bucket.Name, key, s.Transform(key))
 
@@ -475,7 +452,18 @@ func (bctl *BucketCtl) bucket_upload(bucket *Bucket, key string, req *http.Reque
 
 	start := time.Now()
 
-	reply, err = bucket.lookup_serialize(true, s.WriteData(key, req.Body, offset, total_size))
+	reply, err = bucket.lookup_serialize(ctx, so, true, s.WriteData(key, etransport.ContextReader(ctx, req.Body), offset, total_size))
+
+	// body of known size has been charged when request was admitted
+	if req.ContentLength < 0 {
+		bucket.charge_bytes(user, total_size)
+	}
+
+	// client has gone or server is shutting down, this is not a storage failure, PID controllers are not updated
+	if ctx.Err() != nil {
+		err = errors.NewCanceledError(req.URL.String(), "upload", ctx.Err())
+		return
+	}
 
 	// PID controller should aim at some destination performance point
 	// it can be velocity pf the vehicle or deisred write rate
@@ -505,6 +493,7 @@ func (bctl *BucketCtl) bucket_upload(bucket *Bucket, key string, req *http.Reque
 						estring = res.Error.Error()
 					}
 					st.PIDUpdate(update_pain)
+					bctl.PID.Update(st.Ab.String(), &st.PID)
 
 					str = append(str, fmt.Sprintf("{group: %d, time: %d us, e: %f, error: %v, pain: %f -> %f}",
 						res.Group, time_us, e, estring, old_pain, st.PIDPain()))
@@ -531,7 +520,17 @@ func (bctl *BucketCtl) bucket_upload(bucket *Bucket, key string, req *http.Reque
 	return
 }
 
-func (bctl *BucketCtl) Upload(key string, req *http.Request) (reply *reply.LookupResult, bucket *Bucket, err error) {
+// session_error() converts data session creation error, session is not created if request context is already done
+func (bctl *BucketCtl) session_error(ctx context.Context, req *http.Request, op string, err error) error {
+	if ctx.Err() != nil {
+		return errors.NewCanceledError(req.URL.String(), op, ctx.Err())
+	}
+
+	return errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
+		fmt.Sprintf("%s: could not create data session: %v", op, err))
+}
+
+func (bctl *BucketCtl) Upload(ctx context.Context, key string, req *http.Request) (reply *reply.LookupResult, bucket *Bucket, err error) {
 	bucket = bctl.GetBucket(key, req)
 	if bucket == nil {
 		err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
@@ -539,18 +538,18 @@ func (bctl *BucketCtl) Upload(key string, req *http.Request) (reply *reply.Looku
 		return
 	}
 
-	reply, err = bctl.bucket_upload(bucket, key, req)
+	reply, err = bctl.bucket_upload(ctx, bucket, key, req)
 	return
 }
 
-func (bctl *BucketCtl) BucketUpload(bucket_name, key string, req *http.Request) (reply *reply.LookupResult, bucket *Bucket, err error) {
+func (bctl *BucketCtl) BucketUpload(ctx context.Context, bucket_name, key string, req *http.Request) (reply *reply.LookupResult, bucket *Bucket, err error) {
 	bucket, err = bctl.FindBucket(bucket_name)
 	if err != nil {
 		err = errors.NewKeyError(req.URL.String(), http.StatusBadRequest, err.Error())
 		return
 	}
 
-	reply, err = bctl.bucket_upload(bucket, key, req)
+	reply, err = bctl.bucket_upload(ctx, bucket, key, req)
 	return
 }
 
@@ -568,12 +567,14 @@ func (bctl *BucketCtl) SetContentType(key string, w http.ResponseWriter) {
 	return
 }
 
-func (bctl *BucketCtl) SetGroupsTimeout(s *elliptics.Session, bucket *Bucket, key string) {
-	// sort groups by defrag state, increase timeout if needed
-
-	groups := make([]uint32, 0)
-	defrag_groups := make([]uint32, 0)
-	timeout := 30
+// SetGroupsTimeout() sorts groups by defrag state and read health, sets them and read timeout to the session,
+// read timeout is increased if all groups are being defragmented, it is returned to be lowered by client timeout,
+// healthy groups are mixed randomly with weights taken from their read health,
+// groups are opened by the proxy one by one, so that the group which serves the data is known
+func (bctl *BucketCtl) SetGroupsTimeout(s *elliptics.Session, bucket *Bucket, key string) ([]*read_group, time.Duration) {
+	all := make([]*read_group, 0, len(bucket.Group))
+	best := -1.0
+	timeout := bctl.op_timeout(bucket, TimeoutRead)
 
 	for group_id, sg := range bucket.Group {
 		sb, err := sg.FindStatBackendKey(s, key, group_id)
@@ -581,150 +582,293 @@ func (bctl *BucketCtl) SetGroupsTimeout(s *elliptics.Session, bucket *Bucket, ke
 			continue
 		}
 
-		if sb.DefragState != 0 {
-			defrag_groups = append(defrag_groups, group_id)
+		rg := &read_group {
+			group:		group_id,
+			ab:		sb.Ab.String(),
+			defrag:		sb.DefragState != 0,
+		}
+		rg.score, rg.error_rate = bctl.Health.Score(rg.ab)
+
+		if !rg.defrag && (best < 0 || rg.score < best) {
+			best = rg.score
+		}
+
+		all = append(all, rg)
+	}
+
+	healthy := make([]*read_group, 0, len(all))
+	unhealthy := make([]*read_group, 0)
+	defrag := make([]*read_group, 0)
+
+	for _, rg := range all {
+		if rg.defrag {
+			defrag = append(defrag, rg)
+		} else if rg.error_rate > bctl.read_error_rate_limit() ||
+				(best > 0 && rg.score > best * bctl.read_latency_ratio_limit()) {
+			unhealthy = append(unhealthy, rg)
 		} else {
-			groups = append(groups, group_id)
+			healthy = append(healthy, rg)
 		}
 	}
 
-	// Not being defragmented backends first, then those which are currently being defragmented
-	groups = append(groups, defrag_groups...)
-	if len(groups) == len(defrag_groups) {
-		timeout = 90
+	// healthy backends first, then slow or failing backends sorted by their read pain,
+	// then those which are currently being defragmented
+	sort.Sort(read_group_sorter(unhealthy))
+	sort.Sort(read_group_sorter(defrag))
+
+	mix_read_groups(healthy)
+
+	ordered := append(healthy, unhealthy...)
+	ordered = append(ordered, defrag...)
+	if len(ordered) == len(defrag) {
+		timeout = bctl.op_timeout(bucket, TimeoutReadDefrag)
 	}
 
-	// if there are no backends being defragmented, use weights to mix read states
-	// if there are such backends, use strict order and read from non-defragmented backends first
+	// if health and defragmentation do not separate groups, elliptics uses weights to mix read states
+	// of the fallback groups, otherwise they are read in strict order
+	strict := len(unhealthy) != 0 || len(defrag) != 0
 	ioflags := elliptics.IOflag(bctl.Conf.Proxy.ReaderIOFlags) | s.GetIOflags()
-	if len(defrag_groups) == 0 {
+	if !strict {
 		ioflags |= elliptics.DNET_IO_FLAGS_MIX_STATES
 	}
 	s.SetIOflags(ioflags)
 
+	groups := make([]uint32, 0, len(ordered))
+	for _, rg := range ordered {
+		groups = append(groups, rg.group)
+	}
+
 	// there are no stats for bucket groups, use what we have in metadata
 	if len(groups) == 0 {
 		groups = bucket.Meta.Groups
 	}
 
 	s.SetGroups(groups)
-	s.SetTimeout(timeout)
+	s.SetTimeout(int(timeout.Seconds()))
+
+	return ordered, timeout
 }
 
-func (bctl *BucketCtl) Stream(bname, key string, w http.ResponseWriter, req *http.Request) (err error) {
+// open_read_seeker() opens @key in @rgroups one by one, so that the group which has served the data is known,
+// failed group is charged in read health, groups after the opened one are left in session as a fallback
+// for the subsequent reads, every attempt gets its share of the session timeout,
+// so that trying all groups does not take longer than the timeout itself
+func (bctl *BucketCtl) open_read_seeker(ctx context.Context, s *elliptics.Session, key string,
+		rgroups []*read_group) (rs *elliptics.ReadSeeker, served *read_group, err error) {
+	timeout := s.GetTimeout()
+	defer s.SetTimeout(timeout)
+
+	attempt := int(math.Max(1, math.Ceil(float64(timeout) / float64(len(rgroups)))))
+	s.SetTimeout(attempt)
+
+	for i, rg := range rgroups {
+		s.SetGroups([]uint32{rg.group})
+
+		rs, err = elliptics.NewReadSeeker(s, key)
+		if err == nil {
+			fallback := make([]uint32, 0, len(rgroups) - i)
+			for _, next := range rgroups[i:] {
+				fallback = append(fallback, next.group)
+			}
+			s.SetGroups(fallback)
+
+			return rs, rg, nil
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		bctl.Health.UpdateResult(rg.ab, err)
+	}
+
+	return
+}
+
+func (bctl *BucketCtl) Stream(ctx context.Context, bname, key string, w http.ResponseWriter, req *http.Request) (err error) {
 	bucket, err := bctl.FindBucket(bname)
 	if err != nil {
 		err = errors.NewKeyError(req.URL.String(), http.StatusBadRequest, err.Error())
 		return
 	}
 
-	err = bucket.check_auth(req, BucketAuthEmpty)
+	user, err := bucket.check_auth(req, BucketAuthEmpty)
 	if err != nil {
-		err = errors.NewKeyError(req.URL.String(), errors.ErrorStatus(err),
-			fmt.Sprintf("stream: %s", errors.ErrorData(err)))
+		err = errors.PrefixKeyError(err, req.URL.String(), "stream")
 		return
 	}
 
-	s, err := bctl.e.DataSession(req)
+	s, err := bctl.e.DataSession(ctx, req)
 	if err != nil {
-		err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
-			fmt.Sprintf("stream: could not create data session: %v", err))
+		err = bctl.session_error(ctx, req, "stream", err)
 		return
 	}
 	defer s.Delete()
 
 	s.SetFilter(elliptics.SessionFilterAll)
 	s.SetNamespace(bucket.Name)
-	bctl.SetGroupsTimeout(s, bucket, key)
+	rgroups, timeout := bctl.SetGroupsTimeout(s, bucket, key)
+
+	ctx, cancel, _, err := bctl.session_timeout(ctx, s, req, timeout)
+	defer cancel()
+	if err != nil {
+		return
+	}
 
 	log.Printf("stream-trace-id: %x: url: %s, bucket: %s, key: %s, id: %s\n",
 		s.GetTraceID(), req.URL.String(), bucket.Name, key, s.Transform(key))
 
-	rs, err := elliptics.NewReadSeeker(s, key)
+	// groups are opened one by one, so that the group which serves the data is known and its health is accounted,
+	// there are no read groups only if bucket groups have no statistics
+	var rs *elliptics.ReadSeeker
+	var served *read_group
+	if len(rgroups) != 0 {
+		rs, served, err = bctl.open_read_seeker(ctx, s, key, rgroups)
+	} else {
+		rs, err = elliptics.NewReadSeeker(s, key)
+	}
 	if err != nil {
+		if ctx.Err() != nil {
+			err = errors.NewCanceledError(req.URL.String(), "stream", ctx.Err())
+			return
+		}
+
 		err = errors.NewKeyErrorFromEllipticsError(err, req.URL.String(), "stream: could not create read-seeker")
 		return
 	}
 	defer rs.Free()
 
+	hr := &health_reader {
+		ReadSeeker:	rs,
+		ctx:		ctx,
+	}
+
 	bctl.SetContentType(key, w)
-	http.ServeContent(w, req, key, rs.Mtime, rs)
+	http.ServeContent(w, req, key, rs.Mtime, hr)
+	bucket.charge_bytes(user, hr.size)
+
+	if hr.canceled != nil {
+		err = errors.NewCanceledError(req.URL.String(), "stream", hr.canceled)
+		return
+	}
+
+	if served != nil {
+		if hr.err != nil {
+			bctl.Health.UpdateResult(served.ab, hr.err)
+		} else {
+			bctl.Health.UpdateLatency(served.ab, hr.size, hr.duration)
+		}
+	}
 	return
 }
 
 
-func (bctl *BucketCtl) Lookup(bname, key string, req *http.Request) (reply *reply.LookupResult, err error) {
+func (bctl *BucketCtl) Lookup(ctx context.Context, bname, key string, req *http.Request) (reply *reply.LookupResult, err error) {
 	bucket, err := bctl.FindBucket(bname)
 	if err != nil {
 		err = errors.NewKeyError(req.URL.String(), http.StatusBadRequest, err.Error())
 		return
 	}
 
-	err = bucket.check_auth(req, BucketAuthEmpty)
+	_, err = bucket.check_auth(req, BucketAuthEmpty)
 	if err != nil {
-		err = errors.NewKeyError(req.URL.String(), errors.ErrorStatus(err),
-			fmt.Sprintf("upload: %s", errors.ErrorData(err)))
+		err = errors.PrefixKeyError(err, req.URL.String(), "upload")
 		return
 	}
 
 
-	s, err := bctl.e.DataSession(req)
+	s, err := bctl.e.DataSession(ctx, req)
 	if err != nil {
-		err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
-			fmt.Sprintf("lookup: could not create data session: %v", err))
+		err = bctl.session_error(ctx, req, "lookup", err)
 		return
 	}
-	defer s.Delete()
+	so := &session_owner {
+		s:		s,
+	}
+	defer so.Delete()
 
 	s.SetNamespace(bucket.Name)
 	s.SetGroups(bucket.Meta.Groups)
 	s.SetIOflags(elliptics.IOflag(bctl.Conf.Proxy.ReaderIOFlags))
 
+	var cancel context.CancelFunc
+	ctx, cancel, err = bctl.with_timeout(ctx, s, req, bctl.op_timeout(bucket, TimeoutLookup))
+	if err != nil {
+		return
+	}
+	defer cancel()
+
 	log.Printf("lookup-trace-id: %x: url: %s, bucket: %s, key: %s, id: %s\n",
 		s.GetTraceID(), req.URL.String(), bucket.Name, key, s.Transform(key))
 
-	reply, err = bucket.lookup_serialize(false, s.ParallelLookup(key))
+	reply, err = bucket.lookup_serialize(ctx, so, false, s.ParallelLookup(key))
+	if ctx.Err() != nil {
+		err = errors.NewCanceledError(req.URL.String(), "lookup", ctx.Err())
+		return
+	}
+
+	bctl.update_lookup_health(bucket, reply)
 	return
 }
 
-func (bctl *BucketCtl) Delete(bname, key string, req *http.Request) (err error) {
+func (bctl *BucketCtl) Delete(ctx context.Context, bname, key string, req *http.Request) (err error) {
 	bucket, err := bctl.FindBucket(bname)
 	if err != nil {
 		err = errors.NewKeyError(req.URL.String(), http.StatusBadRequest, err.Error())
 		return
 	}
 
-	err = bucket.check_auth(req, BucketAuthWrite)
+	_, err = bucket.check_auth(req, BucketAuthWrite)
 	if err != nil {
-		err = errors.NewKeyError(req.URL.String(), errors.ErrorStatus(err),
-			fmt.Sprintf("upload: %s", errors.ErrorData(err)))
+		err = errors.PrefixKeyError(err, req.URL.String(), "upload")
 		return
 	}
 
 
-	s, err := bctl.e.DataSession(req)
+	s, err := bctl.e.DataSession(ctx, req)
 	if err != nil {
-		err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
-			fmt.Sprintf("delete: could not create data session: %v", err))
+		err = bctl.session_error(ctx, req, "delete", err)
 		return
 	}
-	defer s.Delete()
+	so := &session_owner {
+		s:		s,
+	}
+	defer so.Delete()
 
 	s.SetNamespace(bucket.Name)
 	s.SetGroups(bucket.Meta.Groups)
 	s.SetIOflags(elliptics.IOflag(bctl.Conf.Proxy.WriterIOFlags))
 
+	var cancel context.CancelFunc
+	ctx, cancel, err = bctl.with_timeout(ctx, s, req, bctl.op_timeout(bucket, TimeoutDelete))
+	if err != nil {
+		return
+	}
+	defer cancel()
+
 	log.Printf("delete-trace-id: %x: url: %s, bucket: %s, key: %s, id: %s\n",
 		s.GetTraceID(), req.URL.String(), bucket.Name, key, s.Transform(key))
 
-	for r := range s.Remove(key) {
-		err = r.Error()
+	ch := s.Remove(key)
+	for {
+		select {
+		case r, ok := <-ch:
+			if !ok {
+				return
+			}
+			err = r.Error()
+		case <-ctx.Done():
+			so.detach(func() {
+				for range ch {
+				}
+			})
+			err = errors.NewCanceledError(req.URL.String(), "delete", ctx.Err())
+			return
+		}
 	}
-
-	return
 }
 
-func (bctl *BucketCtl) BulkDelete(bname string, keys []string, req *http.Request) (reply map[string]interface{}, err error) {
+func (bctl *BucketCtl) BulkDelete(ctx context.Context, bname string, keys []string, req *http.Request) (reply map[string]interface{}, err error) {
 	reply = make(map[string]interface{})
 
 	bucket, err := bctl.FindBucket(bname)
@@ -733,58 +877,102 @@ func (bctl *BucketCtl) BulkDelete(bname string, keys []string, req *http.Request
 		return
 	}
 
-	err = bucket.check_auth(req, BucketAuthWrite)
+	_, err = bucket.check_auth(req, BucketAuthWrite)
 	if err != nil {
-		err = errors.NewKeyError(req.URL.String(), errors.ErrorStatus(err),
-			fmt.Sprintf("upload: %s", errors.ErrorData(err)))
+		err = errors.PrefixKeyError(err, req.URL.String(), "upload")
 		return
 	}
 
 
-	s, err := bctl.e.DataSession(req)
+	s, err := bctl.e.DataSession(ctx, req)
 	if err != nil {
-		err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
-			fmt.Sprintf("bulk_delete: could not create data session: %v", err))
+		err = bctl.session_error(ctx, req, "bulk_delete", err)
 		return
 	}
-	defer s.Delete()
+	so := &session_owner {
+		s:		s,
+	}
+	defer so.Delete()
 
 	s.SetNamespace(bucket.Name)
 	s.SetGroups(bucket.Meta.Groups)
 	s.SetIOflags(elliptics.IOflag(bctl.Conf.Proxy.WriterIOFlags))
 
+	// every key is removed in its own transaction, the whole request is only limited by client deadline
+	ctx, cancel, _, err := bctl.session_timeout(ctx, s, req, bctl.op_timeout(bucket, TimeoutDelete))
+	defer cancel()
+	if err != nil {
+		return
+	}
+
 	log.Printf("bulk-delete-trace-id: %x: url: %s, bucket: %s, keys: %v\n",
 		s.GetTraceID(), req.URL.String(), bucket.Name, keys)
 
-	for r := range s.BulkRemove(keys) {
-		err = r.Error()
-		if err != nil {
-			reply[r.Key()] = err.Error()
+	ch := s.BulkRemove(keys)
+	for {
+		select {
+		case r, ok := <-ch:
+			if !ok {
+				err = nil
+				return
+			}
+			if r.Error() != nil {
+				reply[r.Key()] = r.Error().Error()
+			}
+		case <-ctx.Done():
+			so.detach(func() {
+				for range ch {
+				}
+			})
+			err = errors.NewCanceledError(req.URL.String(), "bulk_delete", ctx.Err())
+			return
 		}
 	}
-
-	err = nil
-
-	return
 }
 
 type BucketStat struct {
 	Group		map[string]*elliptics.StatGroupData
+
+	// time of the statistics used for every group, groups with statistics older than max stat age
+	// are also listed in @StaleGroups
+	GroupTime	map[string]string
+	StaleGroups	[]string
+
 	Meta		*BucketMsgpack
 }
 
 type BctlStat struct {
 	Buckets		map[string]*BucketStat
 	StatTime	string
+	StatMaxAge	string
+
+	// address+backend -> time of the last statistics update which has contained it,
+	// only backends with statistics older than max stat age are listed
+	StaleBackends	map[string]string
+
+	// address+backend -> read health
+	ReadHealth	map[string]*ReadHealth
 }
 
 func (bctl *BucketCtl) Stat(req *http.Request, bnames []string) (reply *BctlStat, err error) {
 	bctl.RLock()
 	defer bctl.RUnlock()
 
+	now := time.Now()
+	max_age := bctl.stat_max_age()
+
 	reply = &BctlStat {
 		Buckets:		make(map[string]*BucketStat),
 		StatTime:		bctl.StatTime.String(),
+		StatMaxAge:		max_age.String(),
+		StaleBackends:		make(map[string]string),
+		ReadHealth:		bctl.Health.Copy(),
+	}
+
+	for ab, t := range bctl.BackendStatTime {
+		if now.Sub(t) > max_age {
+			reply.StaleBackends[ab.String()] = t.String()
+		}
 	}
 
 	for _, b := range bctl.AllBuckets() {
@@ -803,13 +991,21 @@ func (bctl *BucketCtl) Stat(req *http.Request, bnames []string) (reply *BctlStat
 		}
 
 		bs := &BucketStat {
-			Group:	make(map[string]*elliptics.StatGroupData),
-			Meta:	&b.Meta,
+			Group:		make(map[string]*elliptics.StatGroupData),
+			GroupTime:	make(map[string]string),
+			StaleGroups:	make([]string, 0),
+			Meta:		&b.Meta,
 		}
 
 		for group, sg := range b.Group {
 			sg_data := sg.StatGroupData()
 			bs.Group[fmt.Sprintf("%d", group)] = sg_data
+
+			t := b.GroupTime[group]
+			bs.GroupTime[fmt.Sprintf("%d", group)] = t.String()
+			if now.Sub(t) > max_age {
+				bs.StaleGroups = append(bs.StaleGroups, fmt.Sprintf("%d", group))
+			}
 		}
 
 		reply.Buckets[b.Name] = bs
@@ -938,51 +1134,201 @@ func (bctl *BucketCtl) EllipticsReadBackrunnerConfig(conf *config.ProxyConfig, c
 	return
 }
 
-func (bctl *BucketCtl) ReadProxyConfig() error {
+// load_proxy_config() reads and validates candidate config, it is read from elliptics if config file
+// contains @BackrunnerConfig key, local config file is only used if there is no good config yet
+func (bctl *BucketCtl) load_proxy_config() (*config.ProxyConfig, error) {
 	conf := &config.ProxyConfig {}
 	err := conf.Load(bctl.proxy_config_path)
 	if err != nil {
-		return fmt.Errorf("could not load proxy config file '%s': %v", bctl.proxy_config_path, err)
+		return nil, fmt.Errorf("could not load proxy config file '%s': %v", bctl.proxy_config_path, err)
 	}
 
-	if len(conf.Elliptics.BackrunnerConfig) != 0 {
-		ell_conf := &config.ProxyConfig {}
-		err = bctl.EllipticsReadBackrunnerConfig(ell_conf, conf.Elliptics.BackrunnerConfig)
-		if err == nil {
-			log.Printf("Successfully read backrunner config from: %s\n", conf.Elliptics.BackrunnerConfig)
-			conf = ell_conf
+	err = conf.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("proxy config file '%s': %v", bctl.proxy_config_path, err)
+	}
+
+	if len(conf.Elliptics.BackrunnerConfig) == 0 {
+		return conf, nil
+	}
+
+	ell_conf := &config.ProxyConfig {}
+	err = bctl.EllipticsReadBackrunnerConfig(ell_conf, conf.Elliptics.BackrunnerConfig)
+	if err == nil {
+		err = ell_conf.Validate()
+	}
+
+	if err != nil {
+		err = fmt.Errorf("backrunner config from %s: %v", conf.Elliptics.BackrunnerConfig, err)
+		if bctl.Conf != nil {
+			return nil, err
 		}
+
+		log.Printf("%v, using local config file '%s'\n", err, bctl.proxy_config_path)
+		return conf, nil
 	}
 
-	if err != nil || len(conf.Elliptics.BackrunnerConfig) == 0 {
-		err = conf.Load(bctl.proxy_config_path)
-		if err != nil {
-			return fmt.Errorf("could not load proxy config file '%s': %v", bctl.proxy_config_path, err)
+	log.Printf("Successfully read backrunner config from: %s\n", conf.Elliptics.BackrunnerConfig)
+	return ell_conf, nil
+}
+
+// check_proxy_config() checks that candidate config works with the storage before it is applied on reload:
+// metadata groups must be reachable with its metadata timeout and its bucket list key must be present,
+// metadata of any known bucket is looked up when bucket list key is not set
+func (bctl *BucketCtl) check_proxy_config(conf *config.ProxyConfig) error {
+	ms, err := elliptics.NewSession(bctl.e.Node)
+	if err != nil {
+		return fmt.Errorf("could not create metadata session: %v", err)
+	}
+	defer ms.Delete()
+
+	ms.SetGroups(bctl.e.MetadataGroups)
+	if conf.Proxy.Timeouts.Metadata > 0 {
+		ms.SetTimeout(conf.Proxy.Timeouts.Metadata)
+	}
+
+	probe := conf.Elliptics.BucketList
+	if len(probe) == 0 {
+		bctl.RLock()
+		if buckets := bctl.AllBuckets(); len(buckets) != 0 {
+			probe = buckets[0].Name
 		}
+		bctl.RUnlock()
 	}
 
-	func () {
+	if len(probe) == 0 {
+		return nil
+	}
+
+	err = metadata_lookup(ms, probe)
+	if err != nil {
+		return fmt.Errorf("health check failed: %v", err)
+	}
+
+	return nil
+}
+
+// ReadProxyConfig() replaces current config with the new one if it differs,
+// candidate config which is not valid or whose log file, jwt keys or admin allowlist can not be loaded is rejected,
+// on reload it is also rejected if it fails health check (see check_proxy_config()),
+// restart-only fields keep running values until restart,
+// @reopen_log forces log file reopen even if config has not been changed (log rotation)
+func (bctl *BucketCtl) ReadProxyConfig(reopen_log bool) (err error) {
+	defer func() {
 		bctl.Lock()
 		defer bctl.Unlock()
-		bctl.Conf = conf
+
+		if err != nil {
+			bctl.ConfigError = err.Error()
+			bctl.ConfigErrorTime = time.Now()
+			log.Printf("read-proxy-config: config has been rejected, using the last known good config: %v\n", err)
+		} else {
+			bctl.ConfigError = ""
+			bctl.ConfigErrorTime = time.Time{}
+		}
 	}()
 
-	if bctl.e.LogFile != nil {
-		bctl.e.LogFile.Close()
+	conf, err := bctl.load_proxy_config()
+	if err != nil {
+		return
+	}
+
+	if bctl.Conf != nil {
+		changes := config.Diff(bctl.Conf, conf)
+		config.KeepRestartFields(bctl.Conf, conf)
+
+		applied := 0
+		pending := make([]string, 0)
+		for _, ch := range changes {
+			if ch.Restart {
+				pending = append(pending, ch.String())
+				continue
+			}
+
+			applied++
+			log.Printf("read-proxy-config: %s\n", ch.String())
+		}
+
+		if p := strings.Join(pending, ", "); p != bctl.restart_pending {
+			bctl.restart_pending = p
+			for _, ch := range pending {
+				log.Printf("read-proxy-config: %s\n", ch)
+			}
+		}
+
+		if applied == 0 && !reopen_log {
+			return nil
+		}
+
+		if applied != 0 {
+			err = bctl.check_proxy_config(conf)
+			if err != nil {
+				return
+			}
+		}
+
+		reopen_log = reopen_log || bctl.Conf.Elliptics.LogFile != conf.Elliptics.LogFile
+	} else {
+		reopen_log = true
 	}
 
-	bctl.e.LogFile, err = os.OpenFile(conf.Elliptics.LogFile, os.O_RDWR | os.O_APPEND | os.O_CREATE, 0644)
+	jwt, err := auth.NewJWTVerifier(&conf.Proxy.JWT)
 	if err != nil {
-		log.Fatalf("Could not open log file '%s': %q", conf.Elliptics.LogFile, err)
+		return fmt.Errorf("could not load jwt keys: %v", err)
+	}
+
+	admin, err := auth.NewAdminRealm(&conf.Proxy)
+	if err != nil {
+		return err
+	}
+
+	if reopen_log {
+		log_file, err := os.OpenFile(conf.Elliptics.LogFile, os.O_RDWR | os.O_APPEND | os.O_CREATE, 0644)
+		if err != nil {
+			if bctl.Conf == nil {
+				log.Fatalf("Could not open log file '%s': %q", conf.Elliptics.LogFile, err)
+			}
+
+			return fmt.Errorf("could not open log file '%s': %v", conf.Elliptics.LogFile, err)
+		}
+
+		if bctl.e.LogFile != nil {
+			bctl.e.LogFile.Close()
+		}
+		bctl.e.LogFile = log_file
+
+		log.SetOutput(bctl.e.LogFile)
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	}
 
 	log.SetPrefix(conf.Elliptics.LogPrefix)
-	log.SetOutput(bctl.e.LogFile)
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	// bucket metadata is read after proxy config, thus new key is used to decrypt ACL tokens
+	err = SetTokenKey(conf.Elliptics.TokenKey)
+	if err != nil {
+		return fmt.Errorf("could not set token key: %v", err)
+	}
+
+	SetJWTVerifier(jwt)
+	SetClientCertSource(conf.Proxy.ClientCertUser)
+	SetRateLimits(conf.Proxy.RateLimit)
+	bctl.e.SetTimeouts(conf.Proxy.Timeouts.Stat, conf.Proxy.Timeouts.Metadata)
+
+	func () {
+		bctl.Lock()
+		defer bctl.Unlock()
+		bctl.Conf = conf
+		bctl.AdminRealm = admin
+	}()
 
 	log.Printf("Proxy config has been updated\n")
 	return nil
+}
 
+// MetadataHeader is written together with every json object stored by UpdateMetadata()
+type MetadataHeader struct {
+	Key string
+	Timestamp int64
 }
 
 func (bctl *BucketCtl) UpdateMetadata(key string, jsi interface{}) (err error) {
@@ -995,16 +1341,11 @@ func (bctl *BucketCtl) UpdateMetadata(key string, jsi interface{}) (err error) {
 
 	ms.SetNamespace(BucketNamespace)
 
-	type Meta struct {
-		Key string
-		Timestamp int64
-	}
-
 	js := struct {
-		Meta Meta
+		Meta MetadataHeader
 		Data interface{}
 	} {
-		Meta {
+		MetadataHeader {
 			key,
 			time.Now().Unix(),
 		},
@@ -1027,6 +1368,74 @@ func (bctl *BucketCtl) UpdateMetadata(key string, jsi interface{}) (err error) {
 
 	return
 }
+
+// ReadMetadata() reads json object written by UpdateMetadata() into @jsi and returns time it was written
+func (bctl *BucketCtl) ReadMetadata(key string, jsi interface{}) (timestamp int64, err error) {
+	ms, err := bctl.e.MetadataSession()
+	if err != nil {
+		log.Printf("%s: metadata read: could not create metadata session: %v", key, err)
+		return
+	}
+	defer ms.Delete()
+
+	ms.SetNamespace(BucketNamespace)
+
+	for rd := range ms.ReadData(key, 0, 0) {
+		if rd.Error() != nil {
+			err = rd.Error()
+
+			log.Printf("%s: metadata read: could not read data: %v", key, err)
+			return
+		}
+
+		js := struct {
+			Meta MetadataHeader
+			Data json.RawMessage
+		} {}
+
+		err = json.Unmarshal(rd.Data(), &js)
+		if err != nil {
+			log.Printf("%s: metadata read: could not parse json: %v", key, err)
+			return
+		}
+
+		err = json.Unmarshal(js.Data, jsi)
+		if err != nil {
+			log.Printf("%s: metadata read: could not parse json data: %v", key, err)
+			return
+		}
+
+		timestamp = js.Meta.Timestamp
+		return
+	}
+
+	err = fmt.Errorf("%s: metadata read: ReadData() returned nothing", key)
+	log.Printf("%v", err)
+	return
+}
+
+// RemoveMetadata() removes object written by UpdateMetadata(), missing object is not an error
+func (bctl *BucketCtl) RemoveMetadata(key string) (err error) {
+	ms, err := bctl.e.MetadataSession()
+	if err != nil {
+		log.Printf("%s: metadata remove: could not create metadata session: %v", key, err)
+		return
+	}
+	defer ms.Delete()
+
+	ms.SetNamespace(BucketNamespace)
+
+	for rr := range ms.Remove(key) {
+		if rr.Error() != nil && errors.EllipticsErrorToStatus(rr.Error()) != http.StatusNotFound {
+			err = rr.Error()
+
+			log.Printf("%s: metadata remove: could not remove data: %v", key, err)
+		}
+	}
+
+	return
+}
+
 type BucketCtlStat struct {
 	StartTime		int64
 	StartTimeString		string
@@ -1037,6 +1446,9 @@ type BucketCtlStat struct {
 	ConfigTime		int64
 	ConfigTimeString	string
 
+	ConfigError		string		`json:",omitempty"`
+	ConfigErrorTime		int64		`json:",omitempty"`
+
 	CurrentTime		int64
 	CurrentTimeString	string
 
@@ -1078,11 +1490,18 @@ func (bctl *BucketCtl) NewBucketCtlStat() (*BucketCtlStat) {
 		EllipticsGoLastCommit:	config.EllipticsGoLastCommit,
 	}
 
+	bctl.RLock()
+	if len(bctl.ConfigError) != 0 {
+		ctl.ConfigError = bctl.ConfigError
+		ctl.ConfigErrorTime = bctl.ConfigErrorTime.Unix()
+	}
+	bctl.RUnlock()
+
 	return ctl
 }
 
-func (bctl *BucketCtl) ReadConfig() (err error) {
-	err = bctl.ReadProxyConfig()
+func (bctl *BucketCtl) ReadConfig(reopen_log bool) (err error) {
+	err = bctl.ReadProxyConfig(reopen_log)
 	if err != nil {
 		err = fmt.Errorf("read-config: failed to update proxy config: %v", err)
 		log.Printf("%s", err)
@@ -1160,7 +1579,9 @@ func (bctl *BucketCtl) DumpProfile(out io.Writer) {
 	bctl.DumpProfileSingle(out, "threadcreate")
 }
 
-func NewBucketCtl(ell *etransport.Elliptics, bucket_path, proxy_config_path string) (bctl *BucketCtl, err error) {
+// @request_rate is set before any background processing starts, since defragmentation scanner reads it without locks
+func NewBucketCtl(ell *etransport.Elliptics, bucket_path, proxy_config_path string,
+		request_rate RateFunc) (bctl *BucketCtl, err error) {
 	bctl = &BucketCtl {
 		e:			ell,
 		bucket_path:		bucket_path,
@@ -1170,20 +1591,31 @@ func NewBucketCtl(ell *etransport.Elliptics, bucket_path, proxy_config_path stri
 		Bucket:			make([]*Bucket, 0, 10),
 		BackBucket:		make([]*Bucket, 0, 10),
 
+		BackendStatTime:	make(map[elliptics.AddressBackend]time.Time),
+
+		PID:			NewPIDStore(),
+		Health:			NewHealthStore(),
+		Defrag:			NewDefragCtl(),
+
 		BucketTimer:		time.NewTimer(time.Second * 30),
 		BucketStatTimer:	time.NewTimer(time.Second * 10),
 
 		DefragTime:		time.Now(),
 		StartTime:		time.Now(),
+
+		RequestRate:		request_rate,
 	}
 
 	runtime.SetBlockProfileRate(1000)
 
-	err = bctl.ReadConfig()
+	err = bctl.ReadConfig(true)
 	if err != nil {
 		return
 	}
 
+	bctl.RestorePIDState()
+	bctl.RestoreDefragHistory()
+
 	signal.Notify(bctl.signals, syscall.SIGHUP)
 
 	go func() {
@@ -1197,7 +1629,7 @@ func NewBucketCtl(ell *etransport.Elliptics, bucket_path, proxy_config_path stri
 		for {
 			select {
 			case <-bctl.BucketTimer.C:
-				bctl.ReadConfig()
+				bctl.ReadConfig(false)
 
 				if bctl.Conf.Proxy.BucketUpdateInterval > 0 {
 					func() {
@@ -1219,8 +1651,8 @@ func NewBucketCtl(ell *etransport.Elliptics, bucket_path, proxy_config_path stri
 				}
 
 			case <-bctl.signals:
-				// reread config and clean back/read-only bucket list
-				bctl.ReadConfig()
+				// reread config, reopen log file and clean back/read-only bucket list
+				bctl.ReadConfig(true)
 				func() {
 					bctl.Lock()
 					defer bctl.Unlock()
@@ -1230,12 +1662,30 @@ func NewBucketCtl(ell *etransport.Elliptics, bucket_path, proxy_config_path stri
 		}
 	}()
 
+	go func() {
+		for {
+			time.Sleep(time.Duration(bctl.pid_state_save_interval()) * time.Second)
+
+			bctl.SavePIDState()
+		}
+	}()
+
+	go func() {
+		for {
+			if err := bctl.PeerHeartbeat(); err != nil {
+				log.Printf("peers: heartbeat has failed: %v\n", err)
+			}
+
+			time.Sleep(time.Duration(bctl.peer_heartbeat_interval()) * time.Second)
+		}
+	}()
+
 	go func() {
 		for {
 			// run defragmentation scan
 			bctl.ScanBuckets()
 
-			time.Sleep(31 * time.Second)
+			time.Sleep(time.Duration(config.DefragScanInterval) * time.Second)
 		}
 	}()
 
@@ -2,6 +2,7 @@ package bucket
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"github.com/DemonVex/backrunner/auth"
 	"github.com/DemonVex/backrunner/errors"
@@ -12,6 +13,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 )
 
 type err_struct struct {
@@ -24,7 +26,7 @@ const BucketNamespace string = "bucket"
 type BucketACL struct {
 	Version int32	`json:"-"`
 	User    string	`json:"user"`
-	Token   string	`json:"token"`
+	Token   string	`json:"-"`
 	Flags   uint64	`json:"flags"`
 }
 
@@ -53,26 +55,38 @@ type BucketMsgpack struct {
 	Flags       uint64			`json:"flags"`
 	MaxSize     uint64			`json:"max-size"`
 	MaxKeyNum   uint64			`json:"max-key-num"`
-	reserved    [3]uint64			`json:"-"`
+
+	// bucket request and uploaded bytes rate limits, zero means default limits from proxy config
+	RateLimitRPS uint64			`json:"rate-limit-rps"`
+	RateLimitBPS uint64			`json:"rate-limit-bps"`
+
+	reserved    [1]uint64			`json:"-"`
+
+	// operation ("read", "read-defrag", "write", "lookup", "delete") -> elliptics timeout in seconds,
+	// it overrides proxy config, it is packed as optional element after reserved fields
+	Timeouts    map[string]uint64		`json:"timeouts"`
 }
 
 func NewBucketMsgpack(name string) *BucketMsgpack {
 	return &BucketMsgpack {
-		Version:	1,
+		Version:	DefaultMetadataVersion(),
 		Name:		name,
 		Groups:		make([]uint32, 0),
 		Acl:		make(map[string]BucketACL),
+		Timeouts:	make(map[string]uint64),
 	}
 }
 
 func (meta *BucketMsgpack) String() string {
 	var acls []string
 	for _, acl := range meta.Acl {
-		acls = append(acls, fmt.Sprintf("%s:%s:0x%x", acl.User, acl.Token, acl.Flags))
+		acls = append(acls, fmt.Sprintf("%s:%s:0x%x", acl.User, redact_token(acl.Token), acl.Flags))
 	}
 
-	return fmt.Sprintf("%s: version: %d, groups: %v, acl: %v, flags: 0x%x, max-size: %d, max-key-num: %d",
-		meta.Name, meta.Version, meta.Groups, acls, meta.Flags, meta.MaxSize, meta.MaxKeyNum)
+	return fmt.Sprintf("%s: version: %d, groups: %v, acl: %v, flags: 0x%x, max-size: %d, max-key-num: %d, " +
+		"rate-limit-rps: %d, rate-limit-bps: %d, timeouts: %v",
+		meta.Name, meta.Version, meta.Groups, acls, meta.Flags, meta.MaxSize, meta.MaxKeyNum,
+		meta.RateLimitRPS, meta.RateLimitBPS, meta.Timeouts)
 }
 
 func (meta *BucketMsgpack) PackMsgpack() (interface{}, error) {
@@ -83,10 +97,19 @@ func (meta *BucketMsgpack) PackMsgpack() (interface{}, error) {
 
 	var acls map[interface{}]interface{} = make(map[interface{}]interface{})
 	for _, acl := range meta.Acl {
+		token := acl.Token
+		if meta.Version == BucketMetadataVersionEncrypted {
+			var err error
+			token, err = encrypt_token(acl.User, acl.Token)
+			if err != nil {
+				return nil, fmt.Errorf("acl: user: %s: could not encrypt token: %v", acl.User, err)
+			}
+		}
+
 		var one_acl []interface{} = make([]interface{}, 4, 4)
 		one_acl[0] = acl.Version
 		one_acl[1] = acl.User
-		one_acl[2] = acl.Token
+		one_acl[2] = token
 		one_acl[3] = acl.Flags
 
 		acls[acl.User] = one_acl
@@ -102,9 +125,20 @@ func (meta *BucketMsgpack) PackMsgpack() (interface{}, error) {
 	out[4] = meta.Flags
 	out[5] = meta.MaxSize
 	out[6] = meta.MaxKeyNum
+	out[7] = meta.RateLimitRPS
+	out[8] = meta.RateLimitBPS
 
 	for i, r := range meta.reserved {
-		out[7 + i] = r
+		out[9 + i] = r
+	}
+
+	// metadata without timeouts is readable by older proxies which expect exactly 10 elements
+	if len(meta.Timeouts) != 0 {
+		timeouts := make(map[interface{}]interface{})
+		for op, t := range meta.Timeouts {
+			timeouts[op] = t
+		}
+		out = append(out, timeouts)
 	}
 
 	return out, nil
@@ -131,7 +165,7 @@ func (meta *BucketMsgpack) ExtractMsgpack(out []interface{}) (err error) {
 		return fmt.Errorf("array length: %d, must be at least 10", len(out))
 	}
 	meta.Version = int32(out[0].(int64))
-	if meta.Version != 1 {
+	if meta.Version != BucketMetadataVersionPlain && meta.Version != BucketMetadataVersionEncrypted {
 		return fmt.Errorf("unsupported metadata version %d", meta.Version)
 	}
 	meta.Name = out[1].(string)
@@ -155,6 +189,12 @@ func (meta *BucketMsgpack) ExtractMsgpack(out []interface{}) (err error) {
 		} else {
 			return fmt.Errorf("acl: could not find token")
 		}
+		if meta.Version == BucketMetadataVersionEncrypted {
+			acl.Token, err = decrypt_token(acl.User, acl.Token)
+			if err != nil {
+				return fmt.Errorf("acl: user: %s: could not decrypt token: %v", acl.User, err)
+			}
+		}
 		if v, ok := cast_to_uint64(x[3]); ok {
 			acl.Flags = uint64(v)
 		} else {
@@ -187,8 +227,33 @@ func (meta *BucketMsgpack) ExtractMsgpack(out []interface{}) (err error) {
 		return fmt.Errorf("could not cast max-key-num '%v'", out[6])
 	}
 
+	// these were reserved fields, they are zero in old metadata
+	meta.RateLimitRPS, _ = cast_to_uint64(out[7])
+	meta.RateLimitBPS, _ = cast_to_uint64(out[8])
+
 	for i := range meta.reserved {
-		meta.reserved[i], _ = cast_to_uint64(out[7 + i])
+		meta.reserved[i], _ = cast_to_uint64(out[9 + i])
+	}
+
+	meta.Timeouts = make(map[string]uint64)
+	if len(out) > 10 {
+		timeouts, ok := out[10].(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("could not cast timeouts '%v'", out[10])
+		}
+
+		for k, v := range timeouts {
+			op, ok := k.(string)
+			if !ok {
+				return fmt.Errorf("timeouts: could not cast operation '%v'", k)
+			}
+			t, ok := cast_to_uint64(v)
+			if !ok {
+				return fmt.Errorf("timeouts: %s: could not cast timeout '%v'", op, v)
+			}
+
+			meta.Timeouts[op] = t
+		}
 	}
 
 	return nil
@@ -198,6 +263,10 @@ type Bucket struct {
 	Name		string
 	Group		map[uint32]*elliptics.StatGroup
 
+	// time of the statistics update which has provided @Group entry,
+	// group with statistics older than max stat age is treated as group without statistics
+	GroupTime	map[uint32]time.Time
+
 	Meta		BucketMsgpack
 }
 
@@ -205,15 +274,62 @@ func NewBucket(name string) *Bucket {
 	return &Bucket {
 		Name:		name,
 		Group:		make(map[uint32]*elliptics.StatGroup),
+		GroupTime:	make(map[uint32]time.Time),
 	}
 }
 
-func (b *Bucket) check_auth(r *http.Request, required_flags uint64) (err error) {
+func check_flags(r *http.Request, user string, flags, required_flags uint64) (err error) {
+	// only require required_flags check if its not @BucketAuthEmpty
+	// @BucketAuthEmpty required_flags is set by reader, non BucketAuthEmpty required_flags are supposed to mean modifications
+	if required_flags != BucketAuthEmpty {
+		// there are no required flags in ACL
+		if (flags & required_flags) == 0 {
+			err = errors.NewKeyError(r.URL.String(), http.StatusForbidden,
+				fmt.Sprintf("auth: user '%s' is not allowed to do action: acl-flags: 0x%x, required-flags: 0x%x",
+					user, flags, required_flags))
+			return
+		}
+	}
+
+	return nil
+}
+
+// check_auth() authenticates request and checks that its user is allowed to perform it and has not exceeded rate limits,
+// it returns bucket ACL user, which is used to charge transferred data (see charge_bytes())
+func (b *Bucket) check_auth(r *http.Request, required_flags uint64) (user string, err error) {
+	user, err = b.authenticate(r, required_flags)
+	if err != nil {
+		return
+	}
+
+	err = b.check_rate_limit(r, user)
+	return
+}
+
+// authenticate() returns bucket ACL user of the request, user is empty if bucket does not have ACL
+func (b *Bucket) authenticate(r *http.Request, required_flags uint64) (user string, err error) {
 	if len(b.Meta.Acl) == 0 {
 		err = nil
 		return
 	}
 
+	// when bearer tokens are not configured, 'Authorization: Bearer' header is handled as before,
+	// i.e. request is authenticated as anonymous '*' user
+	if token, ok := auth.GetBearerToken(r); ok {
+		if v := get_jwt_verifier(); v != nil {
+			return b.check_jwt_auth(r, v, token, required_flags)
+		}
+	}
+
+	// certificate names which are not in ACL fall back to anonymous '*' user
+	if names := client_cert_names(r); len(names) != 0 {
+		var matched bool
+		user, matched, err = b.check_cert_auth(r, names, required_flags)
+		if matched {
+			return
+		}
+	}
+
 	user, recv_auth, err := auth.GetAuthInfo(r)
 	if err != nil {
 		return
@@ -222,24 +338,16 @@ func (b *Bucket) check_auth(r *http.Request, required_flags uint64) (err error)
 	acl, ok := b.Meta.Acl[user]
 	if !ok {
 		err = errors.NewKeyError(r.URL.String(), http.StatusForbidden,
-			fmt.Sprintf("auth: header: '%v': there is no user '%s' in ACL",
-				r.Header[auth.AuthHeaderStr], user))
+			fmt.Sprintf("auth: there is no user '%s' in ACL", user))
 		return
 	}
 
-	log.Printf("check-auth: url: %s, user: %s, token: %s, flags: %x, required: %x\n",
-		r.URL.String(), acl.User, acl.Token, acl.Flags, required_flags)
+	log.Printf("check-auth: url: %s, user: %s, flags: %x, required: %x\n",
+		r.URL.String(), acl.User, acl.Flags, required_flags)
 
-	// only require required_flags check if its not @BucketAuthEmpty
-	// @BucketAuthEmpty required_flags is set by reader, non BucketAuthEmpty required_flags are supposed to mean modifications
-	if required_flags != BucketAuthEmpty {
-		// there are no required flags in ACL
-		if (acl.Flags & required_flags) == 0 {
-			err = errors.NewKeyError(r.URL.String(), http.StatusForbidden,
-				fmt.Sprintf("auth: header: '%v': user '%s' is not allowed to do action: acl-flags: 0x%x, required-flags: 0x%x",
-					r.Header[auth.AuthHeaderStr], user, acl.Flags, required_flags))
-			return
-		}
+	err = check_flags(r, user, acl.Flags, required_flags)
+	if err != nil {
+		return
 	}
 
 	// skip authorization if special ACL flag is set
@@ -251,22 +359,45 @@ func (b *Bucket) check_auth(r *http.Request, required_flags uint64) (err error)
 	calc_auth, err := auth.GenerateSignature(acl.Token, r.Method, r.URL, r.Header)
 	if err != nil {
 		err = errors.NewKeyError(r.URL.String(), http.StatusForbidden,
-			fmt.Sprintf("auth: header: '%v': hmac generation failed: %s",
-				r.Header[auth.AuthHeaderStr], user))
+			fmt.Sprintf("auth: user: %s, hmac generation failed", user))
 		return
 	}
 
 	if recv_auth != calc_auth {
 		err = errors.NewKeyError(r.URL.String(), http.StatusForbidden,
-			fmt.Sprintf("auth: header: '%v': user: %s, hmac mismatch: recv: '%s', calc: '%s'",
-				r.Header[auth.AuthHeaderStr], user, recv_auth, calc_auth))
+			fmt.Sprintf("auth: user: %s, hmac mismatch", user))
 		return
 	}
 
 	return
 }
 
-func (bucket *Bucket) lookup_serialize(write bool, ch <-chan elliptics.Lookuper) (*reply.LookupResult, error) {
+// session_owner deletes elliptics session when request completes, but if request has been canceled
+// while operation is still running, session is deleted by the goroutine which drains operation results
+type session_owner struct {
+	s		*elliptics.Session
+	detached	bool
+}
+
+func (so *session_owner) Delete() {
+	if !so.detached {
+		so.s.Delete()
+	}
+}
+
+// detach() hands session over to the goroutine which deletes it after @drain returns
+func (so *session_owner) detach(drain func()) {
+	so.detached = true
+
+	go func() {
+		drain()
+		so.s.Delete()
+	}()
+}
+
+// lookup_serialize() collects results of the lookup or write operation, it stops waiting when @ctx is done
+// and returns context error, remaining results are drained in background and session is deleted after that
+func (bucket *Bucket) lookup_serialize(ctx context.Context, so *session_owner, write bool, ch <-chan elliptics.Lookuper) (*reply.LookupResult, error) {
 	r := &reply.LookupResult {
 		Servers:		make([]*reply.LookupServerResult, 0, 2),
 		SuccessGroups:		make([]uint32, 0, 2),
@@ -274,7 +405,24 @@ func (bucket *Bucket) lookup_serialize(write bool, ch <-chan elliptics.Lookuper)
 	}
 
 	var err error
-	for l := range ch {
+	for {
+		var l elliptics.Lookuper
+		var ok bool
+
+		select {
+		case l, ok = <-ch:
+		case <-ctx.Done():
+			so.detach(func() {
+				for range ch {
+				}
+			})
+			return r, ctx.Err()
+		}
+
+		if !ok {
+			break
+		}
+
 		ret := &reply.LookupServerResult {
 			Group: l.Cmd().ID.Group,
 			Backend: l.Cmd().Backend,
@@ -415,6 +563,33 @@ func (meta *BucketMsgpack) ExtractJson(iface interface{}) (err error) {
 	if tmp, ok := imap["max-key-num"].(float64); ok {
 		meta.MaxKeyNum = uint64(tmp)
 	}
+	if tmp, ok := imap["rate-limit-rps"].(float64); ok {
+		meta.RateLimitRPS = uint64(tmp)
+	}
+	if tmp, ok := imap["rate-limit-bps"].(float64); ok {
+		meta.RateLimitBPS = uint64(tmp)
+	}
+
+	if timeouts, ok := imap["timeouts"].(map[string]interface{}); ok {
+		if meta.Timeouts == nil {
+			meta.Timeouts = make(map[string]uint64)
+		}
+
+		for op, v := range timeouts {
+			if !ValidTimeoutOperation(op) {
+				err = fmt.Errorf("timeouts: unsupported operation '%s'", op)
+				return
+			}
+
+			t, ok := v.(float64)
+			if !ok || t < 0 {
+				err = fmt.Errorf("timeouts: %s: invalid timeout '%v'", op, v)
+				return
+			}
+
+			meta.Timeouts[op] = uint64(t)
+		}
+	}
 
 	if groups, ok := imap["groups"]; ok {
 		for _, g := range groups.([]interface{}) {
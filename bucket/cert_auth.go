@@ -0,0 +1,56 @@
+package bucket
+
+import (
+	"github.com/DemonVex/backrunner/auth"
+	"log"
+	"net/http"
+	"sync"
+)
+
+var client_cert_source struct {
+	sync.RWMutex
+	source		string
+}
+
+// SetClientCertSource() sets client certificate field which is used as bucket ACL user name
+func SetClientCertSource(source string) {
+	client_cert_source.Lock()
+	defer client_cert_source.Unlock()
+
+	client_cert_source.source = source
+}
+
+func get_client_cert_source() string {
+	client_cert_source.RLock()
+	defer client_cert_source.RUnlock()
+
+	return client_cert_source.source
+}
+
+// check_cert_auth() authenticates request using verified client certificate,
+// the first certificate name which is present in the bucket ACL is used as user,
+// @matched is false if there are no certificate names in ACL, request is authenticated as usual in this case
+func (b *Bucket) check_cert_auth(r *http.Request, names []string, required_flags uint64) (user string, matched bool, err error) {
+	for _, name := range names {
+		acl, ok := b.Meta.Acl[name]
+		if !ok {
+			continue
+		}
+
+		log.Printf("check-auth: cert: url: %s, user: %s, flags: %x, required: %x\n",
+			r.URL.String(), acl.User, acl.Flags, required_flags)
+
+		return acl.User, true, check_flags(r, acl.User, acl.Flags, required_flags)
+	}
+
+	return "", false, nil
+}
+
+// client_cert_names() returns names from the verified client certificate if request does not have other credentials
+func client_cert_names(r *http.Request) []string {
+	if _, ok := r.Header[auth.AuthHeaderStr]; ok {
+		return nil
+	}
+
+	return auth.ClientCertNames(r.TLS, get_client_cert_source())
+}
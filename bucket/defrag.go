@@ -1,91 +1,345 @@
 package bucket
 
 import (
+	"fmt"
+	"github.com/DemonVex/backrunner/errors"
 	"github.com/bioothod/elliptics-go/elliptics"
 	"log"
+	"net/http"
 	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
-type bstat struct {
+const DefragAuditLength int = 256
+
+// RateFunc returns number of requests per second handled by the proxy
+type RateFunc func() float64
+
+// DefragBackend describes address+backend considered for defragmentation
+type DefragBackend struct {
+	Bucket			string
+	Group			uint32
+	Backend			string
+
+	FreeSpaceRate		float64
+	RemovedSpaceRate	float64
+	UsedSize		uint64
+	RemovedSize		uint64
+	TotalSize		uint64
+
+	// why backend does not qualify for defragmentation or will not be defragmented
+	Reason			string		`json:",omitempty"`
+
 	bucket			*Bucket
 	ab			elliptics.AddressBackend
-	free_space_rate		float64
-	removed_space_rate	float64
+	st			*elliptics.StatBackend
 }
 
-type bstat_sorter struct {
-	defrag			[]bstat
+type defrag_sorter struct {
+	defrag			[]*DefragBackend
 }
 
-func (stats bstat_sorter) Len() int {
+func (stats defrag_sorter) Len() int {
 	return len(stats.defrag)
 }
 
-func (stats bstat_sorter) Swap(i, j int) {
+func (stats defrag_sorter) Swap(i, j int) {
 	stats.defrag[i], stats.defrag[j] = stats.defrag[j], stats.defrag[i]
 }
 
-func (stats bstat_sorter) Less(i, j int) bool {
-	return stats.defrag[i].removed_space_rate < stats.defrag[j].removed_space_rate
+func (stats defrag_sorter) Less(i, j int) bool {
+	return stats.defrag[i].RemovedSpaceRate < stats.defrag[j].RemovedSpaceRate
 }
 
-// called without locks
-func (bctl *BucketCtl) DefragBuckets(defrag_buckets []bstat) {
-	if len(defrag_buckets) <= 0 {
+// DefragPlan is a result of the defragmentation scan
+type DefragPlan struct {
+	Time			string
+	DryRun			bool
+
+	// backends which qualify for defragmentation
+	Candidates		[]*DefragBackend
+
+	// candidates which are (or would be in dry-run mode) defragmented according to limits
+	Selected		[]*DefragBackend
+
+	// backends which do not qualify for defragmentation
+	Rejected		[]*DefragBackend
+
+	// buckets which are not scanned at all, bucket name -> reason
+	SkippedBuckets		map[string]string
+
+	// number of backends being defragmented in the whole cluster
+	Running			int
+
+	// requests per second handled by the proxy when plan has been created
+	RequestRate		float64
+
+	// non-empty if no new defragmentation is started at all
+	Postponed		string			`json:",omitempty"`
+}
+
+type DefragAudit struct {
+	Time			string
+	Action			string
+	Target			string		`json:",omitempty"`
+	RemoteAddr		string		`json:",omitempty"`
+	Result			string
+}
+
+type DefragCtl struct {
+	sync.Mutex
+
+	// automatic defragmentation scheduler does not start new defragmentation while paused,
+	// it is a copy of the cluster-wide state stored in metadata groups (see DefragPause)
+	Paused			bool
+
+	// the last plan created by the automatic scheduler
+	LastPlan		*DefragPlan
+
+	// the last seen defragmentation lease
+	Lease			*DefragLease
+
+	// defragmentations started by this proxy, address+backend string -> record
+	Active			map[string]*DefragRecord
+
+	// finished defragmentations, the oldest first
+	History			[]*DefragRecord
+
+	audit			[]DefragAudit
+	audit_index		uint64
+}
+
+func NewDefragCtl() *DefragCtl {
+	return &DefragCtl {
+		Active:		make(map[string]*DefragRecord),
+		History:	make([]*DefragRecord, 0),
+		audit:		make([]DefragAudit, DefragAuditLength),
+	}
+}
+
+func (dctl *DefragCtl) Audit(action, target, remote_addr string, err error) {
+	result := "success"
+	if err != nil {
+		result = err.Error()
+	}
+
+	a := DefragAudit {
+		Time:		time.Now().String(),
+		Action:		action,
+		Target:		target,
+		RemoteAddr:	remote_addr,
+		Result:		result,
+	}
+
+	log.Printf("defrag-audit: action: %s, target: '%s', remote-addr: '%s', result: %s\n",
+		a.Action, a.Target, a.RemoteAddr, a.Result)
+
+	dctl.Lock()
+	defer dctl.Unlock()
+
+	dctl.audit[dctl.audit_index % uint64(len(dctl.audit))] = a
+	dctl.audit_index++
+}
+
+func (dctl *DefragCtl) SetLease(lease *DefragLease) {
+	dctl.Lock()
+	defer dctl.Unlock()
+
+	dctl.Lease = lease
+}
+
+// AuditRecords() returns audit records starting from the oldest one
+func (dctl *DefragCtl) AuditRecords() []DefragAudit {
+	dctl.Lock()
+	defer dctl.Unlock()
+
+	l := uint64(len(dctl.audit))
+	if dctl.audit_index < l {
+		out := make([]DefragAudit, dctl.audit_index)
+		copy(out, dctl.audit)
+		return out
+	}
+
+	out := make([]DefragAudit, 0, l)
+	for i := uint64(0); i < l; i++ {
+		out = append(out, dctl.audit[(dctl.audit_index + i) % l])
+	}
+
+	return out
+}
+
+// defrag_window() returns empty string if defragmentation is allowed to start in given backend now,
+// otherwise it returns the reason, backends which are not covered by any window are not restricted
+func (bctl *BucketCtl) defrag_window(b *DefragBackend, now time.Time) string {
+	if len(bctl.Conf.Proxy.DefragWindows) == 0 {
+		return ""
+	}
+
+	addr := b.ab.Addr.String()
+	covered := false
+	for i := range bctl.Conf.Proxy.DefragWindows {
+		w := &bctl.Conf.Proxy.DefragWindows[i]
+		if !w.Applies(b.Group, addr) {
+			continue
+		}
+		covered = true
+
+		match, err := w.Match(now)
+		if err != nil {
+			log.Printf("defrag: invalid maintenance window: %v\n", err)
+			continue
+		}
+
+		if match {
+			return ""
+		}
+	}
+
+	if !covered {
+		return ""
+	}
+
+	return "outside of maintenance windows"
+}
+
+// DefragSelect() applies defragmentation limits to the plan candidates and sets backends which should be defragmented,
+// candidates which are not selected get their @Reason set
+func (bctl *BucketCtl) DefragSelect(plan *DefragPlan) {
+	plan.Selected = make([]*DefragBackend, 0)
+	if len(plan.Candidates) <= 0 {
 		return
 	}
 
-	sorter := bstat_sorter {
-		defrag: defrag_buckets,
+	postpone := func(reason string) {
+		plan.Postponed = reason
+		for _, b := range plan.Candidates {
+			b.Reason = reason
+		}
 	}
-	sort.Sort(sorter)
 
-	db := make(map[*Bucket]int)
-	addrs := make(map[elliptics.RawAddr]int)
+	if bctl.Conf.Proxy.DefragMaxRPS > 0 && plan.RequestRate > bctl.Conf.Proxy.DefragMaxRPS {
+		postpone(fmt.Sprintf("request rate %.1f rps is higher than limit %.1f rps",
+			plan.RequestRate, bctl.Conf.Proxy.DefragMaxRPS))
+		return
+	}
 
-	s, err := elliptics.NewSession(bctl.e.Node)
-	if err != nil {
-		log.Printf("defag: could not create new session: %v\n", err)
+	max_backends := bctl.Conf.Proxy.DefragMaxBackends
+	if max_backends > 0 && plan.Running >= max_backends {
+		postpone(fmt.Sprintf("there are already %d backends being defragmented in the cluster, limit: %d",
+			plan.Running, max_backends))
 		return
 	}
-	defer s.Delete()
 
-	for idx := len(defrag_buckets) - 1; idx >= 0; idx-- {
-		b := &defrag_buckets[idx]
+	now := time.Now()
+	sorted := make([]*DefragBackend, 0, len(plan.Candidates))
+	for _, b := range plan.Candidates {
+		if reason := bctl.defrag_window(b, now); len(reason) != 0 {
+			b.Reason = reason
+			continue
+		}
+
+		sorted = append(sorted, b)
+	}
+
+	selected := plan.Selected
+
+	sorter := defrag_sorter {
+		defrag: sorted,
+	}
+	sort.Sort(sorter)
+
+	db := make(map[*Bucket]int)
+	addrs := make(map[elliptics.RawAddr]int)
+
+	idx := len(sorted) - 1
+	for ; idx >= 0; idx-- {
+		b := sorted[idx]
 
 		addrs[b.ab.Addr]++
 		defrag_backends_on_storage := addrs[b.ab.Addr]
 
 		if defrag_backends_on_storage <= bctl.Conf.Proxy.DefragMaxBackendsPerServer {
-			log.Printf("defrag: starting defragmentation in bucket: %s, %s, free-space-rate: %f, removed-space-rate: %f\n",
-						b.bucket.Name, b.ab.String(), b.free_space_rate, b.removed_space_rate)
-
-			s.BackendStartDefrag(b.ab.Addr.DnetAddr(), b.ab.Backend)
+			selected = append(selected, b)
 
 			db[b.bucket]++
 			if len(db) >= bctl.Conf.Proxy.DefragMaxBuckets {
 				break
 			}
+
+			if max_backends > 0 && plan.Running + len(selected) >= max_backends {
+				break
+			}
+		} else {
+			b.Reason = fmt.Sprintf("there are already %d backends to be defragmented on this server, limit: %d",
+				defrag_backends_on_storage - 1, bctl.Conf.Proxy.DefragMaxBackendsPerServer)
 		}
 	}
 
-	return
+	for idx--; idx >= 0; idx-- {
+		sorted[idx].Reason = fmt.Sprintf("maximum number of buckets (%d) or backends in the cluster (%d) being defragmented has been reached",
+			bctl.Conf.Proxy.DefragMaxBuckets, max_backends)
+	}
+
+	plan.Selected = selected
 }
 
-func (bctl *BucketCtl) ScanBuckets() {
-	if time.Since(bctl.DefragTime).Seconds() <= 30 {
+// called without locks
+func (bctl *BucketCtl) DefragBuckets(selected []*DefragBackend) {
+	if len(selected) <= 0 {
 		return
 	}
 
-	defrag_buckets := make([]bstat, 0)
+	s, err := elliptics.NewSession(bctl.e.Node)
+	if err != nil {
+		log.Printf("defag: could not create new session: %v\n", err)
+		return
+	}
+	defer s.Delete()
+
+	for _, b := range selected {
+		log.Printf("defrag: starting defragmentation in bucket: %s, %s, free-space-rate: %f, removed-space-rate: %f\n",
+					b.Bucket, b.Backend, b.FreeSpaceRate, b.RemovedSpaceRate)
+
+		s.BackendStartDefrag(b.ab.Addr.DnetAddr(), b.ab.Backend)
+		bctl.Defrag.Start(b.Bucket, b.Group, "auto", b.st)
+		bctl.Defrag.Audit("auto-start", fmt.Sprintf("bucket: %s, %s", b.Bucket, b.Backend), "", nil)
+	}
+
+	return
+}
+
+// DefragPlan() scans buckets and selects backends which should be defragmented, nothing is started here
+func (bctl *BucketCtl) DefragPlan(dry_run bool) *DefragPlan {
+	plan := &DefragPlan {
+		Time:			time.Now().String(),
+		DryRun:			dry_run,
+		Candidates:		make([]*DefragBackend, 0),
+		Rejected:		make([]*DefragBackend, 0),
+		SkippedBuckets:		make(map[string]string),
+	}
+
+	if bctl.RequestRate != nil {
+		plan.RequestRate = bctl.RequestRate()
+	}
 
 	func() {
 		bctl.RLock()
 		defer bctl.RUnlock()
 
-		bctl.DefragTime = time.Now()
-		log.Printf("defrag: starting defrag scanning\n")
+		// the same address+backend can be used by multiple buckets
+		running := make(map[elliptics.AddressBackend]bool)
+		for _, b := range bctl.AllBuckets() {
+			for _, stat_group := range b.Group {
+				for ab, st := range stat_group.Ab {
+					if st.DefragState != 0 {
+						running[ab] = true
+					}
+				}
+			}
+		}
+		plan.Running = len(running)
 
 		for _, b := range bctl.AllBuckets() {
 			groups_defrag_already_running := 0
@@ -116,63 +370,284 @@ func (bctl *BucketCtl) ScanBuckets() {
 			}
 
 			if groups_defrag_already_running * 2 > len(b.Group) {
+				plan.SkippedBuckets[b.Name] = fmt.Sprintf("defragmentation is already running in %d groups out of %d",
+					groups_defrag_already_running, len(b.Group))
 				continue
 			}
 
 			for group_id, stat_group := range b.Group {
 				for ab, st := range stat_group.Ab {
+					bs := &DefragBackend {
+						Bucket:		b.Name,
+						Group:		group_id,
+						Backend:	ab.String(),
+						UsedSize:	st.VFS.BackendUsedSize,
+						RemovedSize:	st.VFS.BackendRemovedSize,
+						TotalSize:	st.VFS.TotalSizeLimit,
+
+						bucket:		b,
+						ab:		ab,
+						st:		st,
+					}
+
+					reject := func(reason string) {
+						bs.Reason = reason
+						plan.Rejected = append(plan.Rejected, bs)
+
+						log.Printf("defrag: bucket: %s, %s: %s\n", b.Name, ab.String(), reason)
+					}
+
 					// there is no statistics for this group, skip it
 					if st.VFS.TotalSizeLimit == 0 {
-						log.Printf("defrag: bucket: %s, %s: no statistics for this backend\n",
-							b.Name, ab.String())
+						reject("no statistics for this backend")
 						continue
 					}
 
 					if st.RO {
-						log.Printf("defrag: bucket: %s, %s: backend is in read-only mode\n",
-							b.Name, ab.String())
+						reject("backend is in read-only mode")
 						continue
 					}
 
-					free_space_rate := FreeSpaceRatio(st, 0)
-					if free_space_rate > bctl.Conf.Proxy.DefragFreeSpaceLimit {
-						log.Printf("defrag: bucket: %s, %s, free-space-rate: %f, must be < %f\n",
-							b.Name, ab.String(), free_space_rate, bctl.Conf.Proxy.DefragFreeSpaceLimit)
+					bs.FreeSpaceRate = FreeSpaceRatio(st, 0)
+					if bs.FreeSpaceRate > bctl.Conf.Proxy.DefragFreeSpaceLimit {
+						reject(fmt.Sprintf("free-space-rate: %f, must be < %f",
+							bs.FreeSpaceRate, bctl.Conf.Proxy.DefragFreeSpaceLimit))
 						continue
 					}
 
-					removed_space_rate := float64(st.VFS.BackendRemovedSize) / float64(st.VFS.TotalSizeLimit)
-					if removed_space_rate < bctl.Conf.Proxy.DefragRemovedSpaceLimit {
-						log.Printf("defrag: bucket: %s, %s, free-space-rate: %f, removed-space-rate: %f, must be > %f\n",
-							b.Name, ab.String(), free_space_rate,
-							removed_space_rate, bctl.Conf.Proxy.DefragRemovedSpaceLimit)
+					bs.RemovedSpaceRate = float64(st.VFS.BackendRemovedSize) / float64(st.VFS.TotalSizeLimit)
+					if bs.RemovedSpaceRate < bctl.Conf.Proxy.DefragRemovedSpaceLimit {
+						reject(fmt.Sprintf("free-space-rate: %f, removed-space-rate: %f, must be > %f",
+							bs.FreeSpaceRate, bs.RemovedSpaceRate, bctl.Conf.Proxy.DefragRemovedSpaceLimit))
 						continue
 					}
 
-					if free_space_rate > 1 || removed_space_rate > 1 {
-						log.Printf("defrag: bucket: %s, %s, free-space-rate: %f, removed-space-rate: %f, invalid stats\n",
-							b.Name, ab.String(), free_space_rate, removed_space_rate)
+					if bs.FreeSpaceRate > 1 || bs.RemovedSpaceRate > 1 {
+						reject(fmt.Sprintf("free-space-rate: %f, removed-space-rate: %f, invalid stats",
+							bs.FreeSpaceRate, bs.RemovedSpaceRate))
 						continue
 					}
 
-					bs := bstat{
-						bucket:            b,
-						ab:            ab,
-						free_space_rate:    free_space_rate,
-						removed_space_rate:    removed_space_rate,
-					}
-
 					log.Printf("defrag: added bucket: %s, %s, group: %d, free-space-rate: %f, removed-space-rate: %f, used: %d, removed: %d, total: %d\n",
-						b.Name, ab.String(), group_id, free_space_rate, removed_space_rate,
+						b.Name, ab.String(), group_id, bs.FreeSpaceRate, bs.RemovedSpaceRate,
 						st.VFS.BackendUsedSize, st.VFS.BackendRemovedSize, st.VFS.TotalSizeLimit)
 
-					defrag_buckets = append(defrag_buckets, bs)
+					plan.Candidates = append(plan.Candidates, bs)
 				}
 			}
 		}
 	}()
 
-	bctl.DefragBuckets(defrag_buckets)
+	bctl.DefragSelect(plan)
+	return plan
+}
+
+func (bctl *BucketCtl) ScanBuckets() {
+	if time.Since(bctl.DefragTime).Seconds() <= 30 {
+		return
+	}
+
+	bctl.DefragTime = time.Now()
+
+	// only one proxy in the cluster schedules defragmentation, otherwise all limits are multiplied,
+	// lease is renewed while defragmentation is paused, so that other proxies do not take scheduling over
+	err := bctl.AcquireDefragLease()
+	if err != nil {
+		log.Printf("defrag: scheduler is not running: %v\n", err)
+		return
+	}
+
+	paused, err := bctl.read_defrag_paused()
+	if err != nil {
+		log.Printf("defrag: could not read pause state, scheduler is not running: %v\n", err)
+		return
+	}
+
+	if paused {
+		log.Printf("defrag: automatic defragmentation is paused\n")
+		return
+	}
+
+	log.Printf("defrag: starting defrag scanning\n")
+	plan := bctl.DefragPlan(false)
+
+	bctl.Defrag.Lock()
+	bctl.Defrag.LastPlan = plan
+	bctl.Defrag.Unlock()
+
+	if len(plan.Postponed) != 0 {
+		log.Printf("defrag: new defragmentation is postponed: %s\n", plan.Postponed)
+	}
+
+	bctl.DefragBuckets(plan.Selected)
+
+	return
+}
+
+type DefragControlReply struct {
+	Action			string
+	Target			string			`json:",omitempty"`
+	Paused			bool
+	Lease			*DefragLease		`json:",omitempty"`
+	Plan			*DefragPlan		`json:",omitempty"`
+	Audit			[]DefragAudit		`json:",omitempty"`
+	History			[]*DefragRecord		`json:",omitempty"`
+	Active			[]*DefragRecord		`json:",omitempty"`
+}
+
+// find_stat_backend() returns bucket name, group and statistics of given address+backend, @bctl must be locked
+func (bctl *BucketCtl) find_stat_backend(addr *elliptics.DnetAddr, backend int32) (string, uint32, *elliptics.StatBackend) {
+	for _, b := range bctl.AllBuckets() {
+		for group_id, sg := range b.Group {
+			st, err := sg.FindStatBackend(addr, backend)
+			if err == nil {
+				return b.Name, group_id, st
+			}
+		}
+	}
+
+	return "", 0, nil
+}
+
+// parse_backend() parses 'addr=host:port:family&backend=id' query parameters
+func parse_backend(req *http.Request) (addr elliptics.DnetAddr, backend int32, target string, err error) {
+	q := req.URL.Query()
+
+	addr_str := q.Get("addr")
+	backend_str := q.Get("backend")
+	target = fmt.Sprintf("%s/%s", addr_str, backend_str)
+
+	if len(addr_str) == 0 || len(backend_str) == 0 {
+		err = errors.NewKeyError(req.URL.String(), http.StatusBadRequest,
+			"defrag: 'addr' and 'backend' parameters must be specified")
+		return
+	}
+
+	addr, err = elliptics.NewDnetAddrStr(addr_str)
+	if err != nil {
+		err = errors.NewKeyError(req.URL.String(), http.StatusBadRequest,
+			fmt.Sprintf("defrag: invalid address '%s': %v", addr_str, err))
+		return
+	}
+
+	b, err := strconv.ParseInt(backend_str, 0, 32)
+	if err != nil {
+		err = errors.NewKeyError(req.URL.String(), http.StatusBadRequest,
+			fmt.Sprintf("defrag: invalid backend '%s': %v", backend_str, err))
+		return
+	}
+
+	backend = int32(b)
+	return
+}
+
+func backend_control_error(ch <-chan *elliptics.DnetBackendsStatus) (err error) {
+	for st := range ch {
+		if st.Error != nil {
+			err = st.Error
+		}
+	}
+
+	return
+}
+
+// DefragControl() runs defragmentation control action:
+//   plan - returns the last plan created by the automatic scheduler
+//   dry-run - scans buckets and returns plan without starting defragmentation
+//   audit - returns audit records
+//   history - returns finished and running defragmentations started by this proxy
+//   start, stop - starts or stops defragmentation in backend specified by 'addr' and 'backend' parameters
+//   pause, resume - pauses or resumes automatic defragmentation scheduler
+// every action is recorded into audit log
+func (bctl *BucketCtl) DefragControl(action string, req *http.Request) (reply *DefragControlReply, err error) {
+	reply = &DefragControlReply {
+		Action:		action,
+	}
+
+	readonly := action == "plan" || action == "dry-run" || action == "audit" || action == "history"
+	if !readonly && req.Method != "POST" && req.Method != "PUT" {
+		err = errors.NewKeyError(req.URL.String(), http.StatusBadRequest,
+			fmt.Sprintf("defrag: action '%s' requires POST or PUT method", action))
+		return
+	}
+
+	defer func() {
+		if action != "audit" && action != "history" {
+			bctl.Defrag.Audit(action, reply.Target, req.RemoteAddr, err)
+		}
+
+		bctl.Defrag.Lock()
+		reply.Paused = bctl.Defrag.Paused
+		reply.Lease = bctl.Defrag.Lease
+		bctl.Defrag.Unlock()
+	}()
+
+	switch action {
+	case "plan":
+		bctl.Defrag.Lock()
+		reply.Plan = bctl.Defrag.LastPlan
+		bctl.Defrag.Unlock()
+
+	case "dry-run":
+		reply.Plan = bctl.DefragPlan(true)
+
+	case "audit":
+		reply.Audit = bctl.Defrag.AuditRecords()
+
+	case "history":
+		reply.History, reply.Active = bctl.Defrag.HistoryCopy()
+
+	case "pause", "resume":
+		err = bctl.SetDefragPaused(action == "pause", req.RemoteAddr)
+		if err != nil {
+			err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
+				fmt.Sprintf("defrag: could not %s defragmentation: %v", action, err))
+			return
+		}
+
+	case "start", "stop":
+		var addr elliptics.DnetAddr
+		var backend int32
+
+		addr, backend, reply.Target, err = parse_backend(req)
+		if err != nil {
+			return
+		}
+
+		var s *elliptics.Session
+		s, err = elliptics.NewSession(bctl.e.Node)
+		if err != nil {
+			err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
+				fmt.Sprintf("defrag: could not create new session: %v", err))
+			return
+		}
+		defer s.Delete()
+
+		if action == "start" {
+			err = backend_control_error(s.BackendStartDefrag(&addr, backend))
+			if err == nil {
+				bctl.RLock()
+				bucket, group, st := bctl.find_stat_backend(&addr, backend)
+				if st != nil {
+					bctl.Defrag.Start(bucket, group, "manual", st)
+				}
+				bctl.RUnlock()
+			}
+		} else {
+			err = backend_control_error(s.BackendStopDefrag(&addr, backend))
+		}
+
+		if err != nil {
+			err = errors.NewKeyErrorFromEllipticsError(err, req.URL.String(),
+				fmt.Sprintf("defrag: %s: %s: backend control failed", action, reply.Target))
+			return
+		}
+
+	default:
+		err = errors.NewKeyError(req.URL.String(), http.StatusBadRequest,
+			fmt.Sprintf("defrag: unsupported action '%s'", action))
+		return
+	}
 
 	return
 }
@@ -0,0 +1,210 @@
+package bucket
+
+import (
+	"github.com/bioothod/elliptics-go/elliptics"
+	"log"
+	"time"
+)
+
+const (
+	DefragHistoryLength int		= 1024
+
+	// defragmentation is considered failed to start if backend statistics
+	// do not show it running (or removed size decreased) within this number of seconds after start request
+	DefragStartTimeout int64	= 600
+
+	// defragmentation is considered lost if its backend is missing in statistics for this number of seconds
+	DefragLostTimeout int64		= 600
+)
+
+// DefragRecord describes one defragmentation started by this proxy
+type DefragRecord struct {
+	Backend			string
+	Bucket			string		`json:",omitempty"`
+	Group			uint32
+
+	// 'auto' for scheduler and 'manual' for control API
+	Trigger			string
+
+	// pending - start request has been sent, but statistics do not show running defragmentation yet,
+	// running, completed, not-started - there were no running defragmentation within @DefragStartTimeout seconds,
+	// lost - backend has been missing in statistics for @DefragLostTimeout seconds
+	Status			string
+
+	StartTime		int64
+	EndTime			int64		`json:",omitempty"`
+	Duration		float64
+
+	UsedSizeStart		uint64
+	UsedSizeEnd		uint64		`json:",omitempty"`
+	RemovedSizeStart	uint64
+	RemovedSizeEnd		uint64		`json:",omitempty"`
+
+	// number of removed bytes freed by the defragmentation
+	Reclaimed		uint64
+
+	ab			elliptics.AddressBackend
+
+	// the last time backend has been present in statistics
+	seen			int64
+}
+
+// defrag_start() starts tracking of the defragmentation in given backend, @dctl must be locked
+func (dctl *DefragCtl) defrag_start(bucket string, group uint32, trigger string, st *elliptics.StatBackend) {
+	rec := &DefragRecord {
+		Backend:		st.Ab.String(),
+		Bucket:			bucket,
+		Group:			group,
+		Trigger:		trigger,
+		Status:			"pending",
+		StartTime:		time.Now().Unix(),
+		UsedSizeStart:		st.VFS.BackendUsedSize,
+		RemovedSizeStart:	st.VFS.BackendRemovedSize,
+
+		ab:			st.Ab,
+		seen:			time.Now().Unix(),
+	}
+
+	dctl.Active[rec.Backend] = rec
+}
+
+func (dctl *DefragCtl) Start(bucket string, group uint32, trigger string, st *elliptics.StatBackend) {
+	dctl.Lock()
+	defer dctl.Unlock()
+
+	dctl.defrag_start(bucket, group, trigger, st)
+}
+
+// Track() updates states of the defragmentations started by this proxy using new statistics,
+// it returns true if some of them have been finished
+func (dctl *DefragCtl) Track(stat *elliptics.DnetStat) bool {
+	dctl.Lock()
+	defer dctl.Unlock()
+
+	if len(dctl.Active) == 0 {
+		return false
+	}
+
+	now := time.Now().Unix()
+	finished := false
+
+	for key, rec := range dctl.Active {
+		var st *elliptics.StatBackend
+		if sg, ok := stat.Group[rec.Group]; ok {
+			st = sg.Ab[rec.ab]
+		}
+
+		if st == nil {
+			if now - rec.seen < DefragLostTimeout {
+				continue
+			}
+
+			rec.Status = "lost"
+		} else {
+			rec.seen = now
+
+			if st.DefragState != 0 {
+				rec.Status = "running"
+				rec.Duration = float64(now - rec.StartTime)
+				continue
+			}
+
+			// defragmentation which has started and finished between statistics updates
+			// is only visible as decreased removed size
+			if rec.Status == "pending" && st.VFS.BackendRemovedSize >= rec.RemovedSizeStart {
+				if now - rec.StartTime < DefragStartTimeout {
+					continue
+				}
+
+				rec.Status = "not-started"
+			} else {
+				rec.Status = "completed"
+			}
+
+			rec.UsedSizeEnd = st.VFS.BackendUsedSize
+			rec.RemovedSizeEnd = st.VFS.BackendRemovedSize
+			if rec.RemovedSizeStart > rec.RemovedSizeEnd {
+				rec.Reclaimed = rec.RemovedSizeStart - rec.RemovedSizeEnd
+			}
+		}
+
+		rec.EndTime = now
+		rec.Duration = float64(rec.EndTime - rec.StartTime)
+
+		log.Printf("defrag: bucket: %s, group: %d, %s: defragmentation %s, duration: %.0f seconds, reclaimed: %d bytes\n",
+			rec.Bucket, rec.Group, rec.Backend, rec.Status, rec.Duration, rec.Reclaimed)
+
+		delete(dctl.Active, key)
+		dctl.History = append(dctl.History, rec)
+		finished = true
+	}
+
+	if len(dctl.History) > DefragHistoryLength {
+		dctl.History = dctl.History[len(dctl.History) - DefragHistoryLength:]
+	}
+
+	return finished
+}
+
+// HistoryCopy() returns copies of the finished and active defragmentation records
+func (dctl *DefragCtl) HistoryCopy() (history []*DefragRecord, active []*DefragRecord) {
+	dctl.Lock()
+	defer dctl.Unlock()
+
+	history = make([]*DefragRecord, 0, len(dctl.History))
+	for _, rec := range dctl.History {
+		tmp := *rec
+		history = append(history, &tmp)
+	}
+
+	active = make([]*DefragRecord, 0, len(dctl.Active))
+	for _, rec := range dctl.Active {
+		tmp := *rec
+		active = append(active, &tmp)
+	}
+
+	return
+}
+
+func defrag_history_key() string {
+	return host_metadata_key("DefragHistory")
+}
+
+func (bctl *BucketCtl) SaveDefragHistory() (err error) {
+	history, _ := bctl.Defrag.HistoryCopy()
+	if len(history) == 0 {
+		return nil
+	}
+
+	key := defrag_history_key()
+	err = bctl.UpdateMetadata(key, history)
+	if err != nil {
+		log.Printf("defrag: %s: could not save history: %v\n", key, err)
+		return
+	}
+
+	log.Printf("defrag: %s: saved %d history records\n", key, len(history))
+	return
+}
+
+func (bctl *BucketCtl) RestoreDefragHistory() (err error) {
+	key := defrag_history_key()
+
+	history := make([]*DefragRecord, 0)
+	_, err = bctl.ReadMetadata(key, &history)
+	if err != nil {
+		return
+	}
+
+	bctl.Defrag.Lock()
+	defer bctl.Defrag.Unlock()
+
+	// records which have been finished after restart are newer than saved ones
+	bctl.Defrag.History = append(history, bctl.Defrag.History...)
+	if len(bctl.Defrag.History) > DefragHistoryLength {
+		bctl.Defrag.History = bctl.Defrag.History[len(bctl.Defrag.History) - DefragHistoryLength:]
+	}
+
+	log.Printf("defrag: %s: restored %d history records\n", key, len(history))
+	return
+}
@@ -0,0 +1,149 @@
+package bucket
+
+import (
+	"fmt"
+	"github.com/DemonVex/backrunner/errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	DefragLeaseKey string		= "DefragLease"
+	DefragPauseKey string		= "DefragPause"
+	DefaultDefragLeaseTTL int	= 120
+
+	// time to wait before reading lease back, concurrent writer (if any) should overwrite our lease during this time
+	DefragLeaseVerifyDelay		= 2 * time.Second
+)
+
+// DefragLease is stored in the metadata groups, only proxy which owns non-expired lease
+// runs automatic defragmentation scheduler
+type DefragLease struct {
+	Owner			string
+	Acquired		int64
+	Expires			int64
+}
+
+// DefragPause is stored in the metadata groups, so that pause and resume requests sent to any proxy
+// affect scheduler of the proxy which owns the lease
+type DefragPause struct {
+	Paused			bool
+	Client			string
+}
+
+// SetDefragPaused() pauses or resumes automatic defragmentation in the whole cluster
+func (bctl *BucketCtl) SetDefragPaused(paused bool, client string) error {
+	err := bctl.UpdateMetadata(DefragPauseKey, &DefragPause {
+		Paused:		paused,
+		Client:		client,
+	})
+	if err != nil {
+		return err
+	}
+
+	bctl.Defrag.Lock()
+	bctl.Defrag.Paused = paused
+	bctl.Defrag.Unlock()
+
+	return nil
+}
+
+// read_defrag_paused() reads cluster-wide pause state, there is no pause record until the first pause request
+func (bctl *BucketCtl) read_defrag_paused() (bool, error) {
+	pause := &DefragPause {}
+	_, err := bctl.ReadMetadata(DefragPauseKey, pause)
+	if err != nil {
+		if errors.EllipticsErrorToStatus(err) != http.StatusNotFound {
+			return false, err
+		}
+
+		return false, nil
+	}
+
+	bctl.Defrag.Lock()
+	bctl.Defrag.Paused = pause.Paused
+	bctl.Defrag.Unlock()
+
+	return pause.Paused, nil
+}
+
+func (l *DefragLease) Expired(now int64) bool {
+	return l.Expires < now
+}
+
+// proxy_id() identifies this proxy process in the cluster, several proxies may run on the same host
+func proxy_id() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = ""
+	}
+
+	return fmt.Sprintf("%s/%d", hostname, os.Getpid())
+}
+
+func (bctl *BucketCtl) defrag_lease_ttl() int {
+	if bctl.Conf.Proxy.DefragLeaseTTL > 0 {
+		return bctl.Conf.Proxy.DefragLeaseTTL
+	}
+
+	return DefaultDefragLeaseTTL
+}
+
+// AcquireDefragLease() returns nil if this proxy owns defragmentation lease,
+// lease is acquired if it does not exist or has expired, and renewed if this proxy already owns it
+//
+// Metadata groups do not support compare-and-swap, so lease is read back after a delay to verify
+// that no other proxy has overwritten it. Proxies which write lease at the very same time
+// will all see the last writer as the owner.
+func (bctl *BucketCtl) AcquireDefragLease() (err error) {
+	owner := proxy_id()
+	now := time.Now().Unix()
+
+	lease := &DefragLease {}
+	_, err = bctl.ReadMetadata(DefragLeaseKey, lease)
+	if err != nil {
+		if errors.EllipticsErrorToStatus(err) != http.StatusNotFound {
+			return fmt.Errorf("could not read lease: %v", err)
+		}
+
+		lease = &DefragLease {}
+	}
+
+	if len(lease.Owner) != 0 && lease.Owner != owner && !lease.Expired(now) {
+		bctl.Defrag.SetLease(lease)
+		return fmt.Errorf("lease is owned by %s till %s", lease.Owner, time.Unix(lease.Expires, 0).String())
+	}
+
+	if lease.Owner != owner {
+		lease.Owner = owner
+		lease.Acquired = now
+	}
+	lease.Expires = now + int64(bctl.defrag_lease_ttl())
+
+	err = bctl.UpdateMetadata(DefragLeaseKey, lease)
+	if err != nil {
+		return fmt.Errorf("could not write lease: %v", err)
+	}
+
+	time.Sleep(DefragLeaseVerifyDelay)
+
+	check := &DefragLease {}
+	_, err = bctl.ReadMetadata(DefragLeaseKey, check)
+	if err != nil {
+		return fmt.Errorf("could not verify lease: %v", err)
+	}
+
+	bctl.Defrag.SetLease(check)
+
+	if check.Owner != owner {
+		return fmt.Errorf("lease has been taken over by %s", check.Owner)
+	}
+
+	if lease.Acquired == now {
+		log.Printf("defrag: lease has been acquired by %s till %s\n", owner, time.Unix(check.Expires, 0).String())
+	}
+
+	return nil
+}
@@ -0,0 +1,279 @@
+package bucket
+
+import (
+	"context"
+	"github.com/DemonVex/backrunner/errors"
+	"github.com/DemonVex/backrunner/estimator"
+	"github.com/DemonVex/backrunner/reply"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultReadErrorRateLimit float64	= 0.1
+	DefaultReadLatencyRatioLimit float64	= 3.0
+
+	// error rate is converted into read pain using this multiplier,
+	// it is randomly selected large number of useconds per byte
+	ReadErrorPain float64			= 1000.0
+)
+
+// ReadHealth tracks read performance of one address+backend
+type ReadHealth struct {
+	// moving average of the number of useconds needed to read one byte
+	Latency		float64
+
+	// moving average of the ratio of failed reads
+	ErrorRate	float64
+
+	Reads		uint64
+	Errors		uint64
+
+	LastError	string		`json:",omitempty"`
+	LastErrorTime	int64		`json:",omitempty"`
+	Timestamp	int64
+}
+
+// Score() returns read pain of the backend, the lower the better
+func (rh *ReadHealth) Score() float64 {
+	return rh.Latency + rh.ErrorRate * ReadErrorPain
+}
+
+type HealthStore struct {
+	sync.Mutex
+
+	// address+backend string -> read health
+	Health		map[string]*ReadHealth
+}
+
+func NewHealthStore() *HealthStore {
+	return &HealthStore {
+		Health:		make(map[string]*ReadHealth),
+	}
+}
+
+func (hs *HealthStore) get(ab string) *ReadHealth {
+	rh, ok := hs.Health[ab]
+	if !ok {
+		rh = &ReadHealth {}
+		hs.Health[ab] = rh
+	}
+
+	return rh
+}
+
+// UpdateLatency() records successful read of @size bytes which took @duration
+func (hs *HealthStore) UpdateLatency(ab string, size uint64, duration time.Duration) {
+	if size == 0 {
+		return
+	}
+
+	e := float64(duration.Nanoseconds() / 1000) / float64(size)
+
+	hs.Lock()
+	defer hs.Unlock()
+
+	rh := hs.get(ab)
+	if rh.Reads == 0 {
+		rh.Latency = e
+	} else {
+		rh.Latency = estimator.MovingExpAvg(e, rh.Latency, 1, 10)
+	}
+	rh.ErrorRate = estimator.MovingExpAvg(0, rh.ErrorRate, 1, 10)
+	rh.Reads++
+	rh.Timestamp = time.Now().Unix()
+}
+
+// UpdateResult() records read operation result without any data, for example lookup,
+// only errors which are backend's fault change the error rate
+func (hs *HealthStore) UpdateResult(ab string, err error) {
+	failed := err != nil && health_error(err)
+	if err != nil && !failed {
+		return
+	}
+
+	hs.Lock()
+	defer hs.Unlock()
+
+	rh := hs.get(ab)
+	rh.Reads++
+	rh.Timestamp = time.Now().Unix()
+
+	if failed {
+		rh.Errors++
+		rh.ErrorRate = estimator.MovingExpAvg(1, rh.ErrorRate, 1, 10)
+		rh.LastError = err.Error()
+		rh.LastErrorTime = rh.Timestamp
+	} else {
+		rh.ErrorRate = estimator.MovingExpAvg(0, rh.ErrorRate, 1, 10)
+	}
+}
+
+// Score() returns read pain of given address+backend, backends without history are considered healthy
+func (hs *HealthStore) Score(ab string) (score float64, error_rate float64) {
+	hs.Lock()
+	defer hs.Unlock()
+
+	rh, ok := hs.Health[ab]
+	if !ok {
+		return 0, 0
+	}
+
+	return rh.Score(), rh.ErrorRate
+}
+
+func (hs *HealthStore) Copy() map[string]*ReadHealth {
+	hs.Lock()
+	defer hs.Unlock()
+
+	out := make(map[string]*ReadHealth)
+	for ab, rh := range hs.Health {
+		tmp := *rh
+		out[ab] = &tmp
+	}
+
+	return out
+}
+
+type read_group struct {
+	group		uint32
+	ab		string
+	defrag		bool
+
+	score		float64
+	error_rate	float64
+}
+
+type read_group_sorter []*read_group
+
+func (rgs read_group_sorter) Len() int {
+	return len(rgs)
+}
+
+func (rgs read_group_sorter) Swap(i, j int) {
+	rgs[i], rgs[j] = rgs[j], rgs[i]
+}
+
+func (rgs read_group_sorter) Less(i, j int) bool {
+	return rgs[i].score < rgs[j].score
+}
+
+// mix_read_groups() shuffles groups randomly, groups with lower read pain are more likely to be first,
+// all groups are equally likely when there are no health statistics
+func mix_read_groups(rgs []*read_group) {
+	mean := 0.0
+	for _, rg := range rgs {
+		mean += rg.score
+	}
+	mean /= float64(len(rgs))
+
+	weight := func(rg *read_group) float64 {
+		if mean <= 0 {
+			return 1
+		}
+
+		return 1 / (1 + rg.score / mean)
+	}
+
+	for i := range rgs {
+		total := 0.0
+		for _, rg := range rgs[i:] {
+			total += weight(rg)
+		}
+
+		r := rand.Float64() * total
+		j := i
+		for ; j < len(rgs) - 1; j++ {
+			r -= weight(rgs[j])
+			if r < 0 {
+				break
+			}
+		}
+
+		rgs[i], rgs[j] = rgs[j], rgs[i]
+	}
+}
+
+func (bctl *BucketCtl) read_error_rate_limit() float64 {
+	if bctl.Conf.Proxy.ReadErrorRateLimit > 0 {
+		return bctl.Conf.Proxy.ReadErrorRateLimit
+	}
+
+	return DefaultReadErrorRateLimit
+}
+
+func (bctl *BucketCtl) read_latency_ratio_limit() float64 {
+	if bctl.Conf.Proxy.ReadLatencyRatioLimit > 0 {
+		return bctl.Conf.Proxy.ReadLatencyRatioLimit
+	}
+
+	return DefaultReadLatencyRatioLimit
+}
+
+func (bctl *BucketCtl) update_lookup_health(bucket *Bucket, reply *reply.LookupResult) {
+	if reply == nil {
+		return
+	}
+
+	bctl.RLock()
+	defer bctl.RUnlock()
+
+	for _, res := range reply.Servers {
+		sg, ok := bucket.Group[res.Group]
+		if !ok {
+			continue
+		}
+
+		st, err := sg.FindStatBackend(res.Addr, res.Backend)
+		if err != nil {
+			continue
+		}
+
+		if res.Error != nil {
+			bctl.Health.UpdateResult(st.Ab.String(), res.Error)
+		} else {
+			bctl.Health.UpdateResult(st.Ab.String(), nil)
+		}
+	}
+}
+
+// health_error() returns true if error means problems with the backend,
+// for example missing key is not a backend's fault
+func health_error(err error) bool {
+	return errors.EllipticsErrorToStatus(err) >= http.StatusInternalServerError
+}
+
+// health_reader measures time spent reading data from the storage, time spent sending data
+// to the client is not accounted
+type health_reader struct {
+	io.ReadSeeker
+
+	// reading is aborted when request context is done, it is not accounted as backend error
+	ctx		context.Context
+	canceled	error
+
+	size		uint64
+	duration	time.Duration
+	err		error
+}
+
+func (hr *health_reader) Read(p []byte) (n int, err error) {
+	if err = hr.ctx.Err(); err != nil {
+		hr.canceled = err
+		return
+	}
+
+	start := time.Now()
+	n, err = hr.ReadSeeker.Read(p)
+	hr.duration += time.Since(start)
+	hr.size += uint64(n)
+
+	if err != nil && err != io.EOF {
+		hr.err = err
+	}
+
+	return
+}
@@ -0,0 +1,52 @@
+package bucket
+
+import (
+	"testing"
+)
+
+func TestMixReadGroups(t *testing.T) {
+	first := make(map[uint32]int)
+
+	for i := 0; i < 10000; i++ {
+		rgs := []*read_group {
+			&read_group{group: 1, score: 1},
+			&read_group{group: 2, score: 10},
+			&read_group{group: 3, score: 1},
+		}
+
+		mix_read_groups(rgs)
+
+		seen := make(map[uint32]bool)
+		for _, rg := range rgs {
+			seen[rg.group] = true
+		}
+		if len(seen) != 3 {
+			t.Fatalf("groups have been lost: %v", seen)
+		}
+
+		first[rgs[0].group]++
+	}
+
+	// every group gets reads, but slow group is selected less often than fast ones
+	if first[2] == 0 || first[2] * 2 > first[1] || first[2] * 2 > first[3] {
+		t.Fatalf("invalid distribution of the first group: %v", first)
+	}
+}
+
+func TestMixReadGroupsNoStat(t *testing.T) {
+	first := make(map[uint32]int)
+
+	for i := 0; i < 10000; i++ {
+		rgs := []*read_group {
+			&read_group{group: 1},
+			&read_group{group: 2},
+		}
+
+		mix_read_groups(rgs)
+		first[rgs[0].group]++
+	}
+
+	if first[1] < 4000 || first[2] < 4000 {
+		t.Fatalf("groups without statistics must be selected equally: %v", first)
+	}
+}
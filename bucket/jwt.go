@@ -0,0 +1,59 @@
+package bucket
+
+import (
+	"fmt"
+	"github.com/DemonVex/backrunner/auth"
+	"github.com/DemonVex/backrunner/errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var jwt_verifier struct {
+	sync.RWMutex
+	v		*auth.JWTVerifier
+}
+
+// SetJWTVerifier() sets verifier of the bearer tokens, nil verifier disables bearer token authentication
+func SetJWTVerifier(v *auth.JWTVerifier) {
+	jwt_verifier.Lock()
+	defer jwt_verifier.Unlock()
+
+	jwt_verifier.v = v
+}
+
+func get_jwt_verifier() *auth.JWTVerifier {
+	jwt_verifier.RLock()
+	defer jwt_verifier.RUnlock()
+
+	return jwt_verifier.v
+}
+
+// check_jwt_auth() verifies bearer token, its user must be present in the bucket ACL,
+// token flags (if any) can only limit flags of the ACL
+func (b *Bucket) check_jwt_auth(r *http.Request, v *auth.JWTVerifier, token string, required_flags uint64) (user string, err error) {
+	id, err := v.Verify(token, time.Now())
+	if err != nil {
+		err = errors.NewKeyError(r.URL.String(), http.StatusForbidden,
+			fmt.Sprintf("auth: %v", err))
+		return
+	}
+
+	acl, ok := b.Meta.Acl[id.User]
+	if !ok {
+		err = errors.NewKeyError(r.URL.String(), http.StatusForbidden,
+			fmt.Sprintf("auth: jwt: there is no user '%s' in ACL", id.User))
+		return
+	}
+
+	flags := acl.Flags
+	if id.HasFlags {
+		flags &= id.Flags
+	}
+
+	log.Printf("check-auth: jwt: url: %s, user: %s, flags: %x, required: %x\n",
+		r.URL.String(), acl.User, flags, required_flags)
+
+	return id.User, check_flags(r, id.User, flags, required_flags)
+}
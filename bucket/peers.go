@@ -0,0 +1,250 @@
+package bucket
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/DemonVex/backrunner/config"
+	"github.com/DemonVex/backrunner/errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// shared key which contains identifiers (hostname/address) of all proxies which have ever sent heartbeat
+	PeersIndexKey string		= "PeersIndex"
+
+	DefaultPeerHeartbeatInterval int	= 30
+
+	// peer is stale if it has not sent heartbeat for this number of heartbeat intervals
+	PeerStaleIntervals int64	= 3
+
+	// peer is removed from the index if it has not sent heartbeat for this number of seconds,
+	// stale peers of the same host are removed at once, since they are restarted proxies or proxies which
+	// have changed their listen address
+	PeerForgetTimeout int64		= 7 * 24 * 3600
+)
+
+// PeerRecord is periodically written by every proxy into the metadata groups
+type PeerRecord struct {
+	// hostname/address, it does not change when proxy restarts
+	ID			string
+	Hostname		string
+	Pid			int
+	Address			string
+	HTTPSAddress		string		`json:",omitempty"`
+
+	BuildDate		string
+	LastCommit		string
+	EllipticsGoLastCommit	string
+
+	StartTime		int64
+	ConfigTime		int64
+	ConfigHash		string
+
+	Heartbeat		int64
+
+	// set when record is read back by /peers/ handler
+	Stale			bool		`json:",omitempty"`
+	Error			string		`json:",omitempty"`
+}
+
+type PeersReply struct {
+	Time			int64
+	Peers			[]*PeerRecord
+	Warnings		[]string	`json:",omitempty"`
+}
+
+func peer_key(id string) string {
+	return fmt.Sprintf("%s.Peer", id)
+}
+
+// peer_id() identifies proxy in the peers registry, several proxies on the same host listen on different addresses
+func peer_id(hostname, address, https_address string) string {
+	if len(address) == 0 {
+		address = https_address
+	}
+
+	return fmt.Sprintf("%s/%s", hostname, address)
+}
+
+func (bctl *BucketCtl) peer_heartbeat_interval() int {
+	if bctl.Conf.Proxy.PeerHeartbeatInterval > 0 {
+		return bctl.Conf.Proxy.PeerHeartbeatInterval
+	}
+
+	return DefaultPeerHeartbeatInterval
+}
+
+// config_hash() returns hash of the currently used proxy config without secrets, @bctl must be locked
+func (bctl *BucketCtl) config_hash() string {
+	data, err := json.Marshal(bctl.Conf.Redacted())
+	if err != nil {
+		return ""
+	}
+
+	h := sha1.Sum(data)
+	return hex.EncodeToString(h[:])
+}
+
+func (bctl *BucketCtl) NewPeerRecord() *PeerRecord {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("peers: hostname error: %v", err)
+		hostname = ""
+	}
+
+	bctl.RLock()
+	defer bctl.RUnlock()
+
+	return &PeerRecord {
+		ID:			peer_id(hostname, bctl.Conf.Proxy.Address, bctl.Conf.Proxy.HTTPSAddress),
+		Hostname:		hostname,
+		Pid:			os.Getpid(),
+		Address:		bctl.Conf.Proxy.Address,
+		HTTPSAddress:		bctl.Conf.Proxy.HTTPSAddress,
+
+		BuildDate:		config.BuildDate,
+		LastCommit:		config.LastCommit,
+		EllipticsGoLastCommit:	config.EllipticsGoLastCommit,
+
+		StartTime:		bctl.StartTime.Unix(),
+		ConfigTime:		bctl.ConfigTime.Unix(),
+		ConfigHash:		bctl.config_hash(),
+
+		Heartbeat:		time.Now().Unix(),
+	}
+}
+
+// PeerHeartbeat() writes registration record of this proxy and adds it into the shared peers index
+// Index is updated with read-modify-write without any locking, if concurrent update loses our identifier,
+// it will be added back on the next heartbeat, index is not updated if it can not be read,
+// otherwise other peers would be lost, records of the peers removed from the index are removed too
+func (bctl *BucketCtl) PeerHeartbeat() (err error) {
+	rec := bctl.NewPeerRecord()
+
+	err = bctl.UpdateMetadata(peer_key(rec.ID), rec)
+	if err != nil {
+		return
+	}
+
+	index := make(map[string]int64)
+	_, err = bctl.ReadMetadata(PeersIndexKey, &index)
+	if err != nil {
+		if errors.EllipticsErrorToStatus(err) != http.StatusNotFound {
+			return
+		}
+
+		index = make(map[string]int64)
+	}
+
+	bctl.RLock()
+	stale_timeout := int64(bctl.peer_heartbeat_interval()) * PeerStaleIntervals
+	bctl.RUnlock()
+
+	forgotten := make([]string, 0)
+	for id, heartbeat := range index {
+		if id == rec.ID {
+			continue
+		}
+
+		age := rec.Heartbeat - heartbeat
+		if age > PeerForgetTimeout || (age > stale_timeout && strings.HasPrefix(id, rec.Hostname + "/")) {
+			delete(index, id)
+			forgotten = append(forgotten, id)
+		}
+	}
+
+	index[rec.ID] = rec.Heartbeat
+
+	err = bctl.UpdateMetadata(PeersIndexKey, index)
+	if err != nil {
+		return
+	}
+
+	for _, id := range forgotten {
+		if rerr := bctl.RemoveMetadata(peer_key(id)); rerr == nil {
+			log.Printf("peers: %s has been forgotten\n", id)
+		}
+	}
+
+	return
+}
+
+// group_peers() returns warning if live peers have different values of the given field
+func group_peers(peers []*PeerRecord, name string, field func(p *PeerRecord) string) string {
+	groups := make(map[string][]string)
+	for _, p := range peers {
+		if p.Stale || len(p.Error) != 0 {
+			continue
+		}
+
+		v := field(p)
+		groups[v] = append(groups[v], p.ID)
+	}
+
+	if len(groups) <= 1 {
+		return ""
+	}
+
+	parts := make([]string, 0, len(groups))
+	for v, hosts := range groups {
+		parts = append(parts, fmt.Sprintf("%s: %v", v, hosts))
+	}
+	sort.Strings(parts)
+
+	return fmt.Sprintf("peers run different %s: %s", name, strings.Join(parts, ", "))
+}
+
+// Peers() reads registration records of all proxies from the metadata groups
+func (bctl *BucketCtl) Peers() (reply *PeersReply, err error) {
+	index := make(map[string]int64)
+	_, err = bctl.ReadMetadata(PeersIndexKey, &index)
+	if err != nil {
+		return
+	}
+
+	reply = &PeersReply {
+		Time:		time.Now().Unix(),
+		Peers:		make([]*PeerRecord, 0, len(index)),
+		Warnings:	make([]string, 0),
+	}
+
+	stale_timeout := int64(bctl.peer_heartbeat_interval()) * PeerStaleIntervals
+
+	ids := make([]string, 0, len(index))
+	for id := range index {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		rec := &PeerRecord {}
+		_, err := bctl.ReadMetadata(peer_key(id), rec)
+		if err != nil {
+			rec.ID = id
+			rec.Heartbeat = index[id]
+			rec.Error = err.Error()
+		}
+
+		if reply.Time - rec.Heartbeat > stale_timeout {
+			rec.Stale = true
+		}
+
+		reply.Peers = append(reply.Peers, rec)
+	}
+
+	if w := group_peers(reply.Peers, "builds", func(p *PeerRecord) string { return p.LastCommit }); len(w) != 0 {
+		reply.Warnings = append(reply.Warnings, w)
+	}
+	if w := group_peers(reply.Peers, "configs", func(p *PeerRecord) string { return p.ConfigHash }); len(w) != 0 {
+		reply.Warnings = append(reply.Warnings, w)
+	}
+
+	return reply, nil
+}
@@ -0,0 +1,202 @@
+package bucket
+
+import (
+	"fmt"
+	"github.com/bioothod/elliptics-go/elliptics"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPIDStateSaveInterval int	= 60
+	DefaultPIDStateMaxAge int	= 3600
+)
+
+// PIDState is a state of the write PID controller of one address+backend
+// Controller itself lives in the elliptics statistics object, which is replaced on every statistics update
+// and is lost on restart, this structure allows to restore new controller to the saved state
+type PIDState struct {
+	// the last controller input, i.e. number of useconds needed to write one byte
+	// or error pain if write has failed
+	Error		float64
+
+	// integral term of the controller
+	Integral	float64
+
+	// controller output when state has been updated last time
+	Pain		float64
+
+	Updates		uint64
+	Timestamp	int64
+}
+
+type PIDStore struct {
+	sync.Mutex
+
+	// address+backend string -> controller state
+	State		map[string]*PIDState
+}
+
+func NewPIDStore() *PIDStore {
+	return &PIDStore {
+		State:		make(map[string]*PIDState),
+	}
+}
+
+// Update() saves state of the controller of the @ab address+backend
+func (ps *PIDStore) Update(ab string, pid *elliptics.PIDController) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	state, ok := ps.State[ab]
+	if !ok {
+		state = &PIDState {}
+		ps.State[ab] = state
+	}
+
+	state.Error = pid.ErrorPrev
+	state.Integral = pid.IntegralError
+	state.Pain = pid.Pain
+	state.Updates++
+	state.Timestamp = time.Now().Unix()
+}
+
+// Copy() returns copy of all states which are not older than @max_age seconds
+func (ps *PIDStore) Copy(max_age int) map[string]*PIDState {
+	ps.Lock()
+	defer ps.Unlock()
+
+	limit := time.Now().Unix() - int64(max_age)
+	out := make(map[string]*PIDState)
+	for ab, state := range ps.State {
+		if state.Timestamp < limit {
+			continue
+		}
+
+		tmp := *state
+		out[ab] = &tmp
+	}
+
+	return out
+}
+
+// Merge() adds saved states, existing states are only replaced by newer ones
+func (ps *PIDStore) Merge(states map[string]*PIDState) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	for ab, state := range states {
+		if old, ok := ps.State[ab]; ok && old.Timestamp >= state.Timestamp {
+			continue
+		}
+
+		ps.State[ab] = state
+	}
+}
+
+// Apply() restores controllers of the backends in given group which have not been updated yet,
+// time of the last update is reset to the current time, since there were no updates while controller was lost
+func (ps *PIDStore) Apply(sg *elliptics.StatGroup, max_age int) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	limit := time.Now().Unix() - int64(max_age)
+
+	for ab, st := range sg.Ab {
+		if st.PIDPain() != 0 {
+			continue
+		}
+
+		state, ok := ps.State[ab.String()]
+		if !ok || state.Pain == 0 || state.Timestamp < limit {
+			continue
+		}
+
+		st.PID.Pain = state.Pain
+		st.PID.IntegralError = state.Integral
+		st.PID.ErrorPrev = state.Error
+		st.PID.LastTime = time.Now()
+	}
+}
+
+func (bctl *BucketCtl) pid_state_max_age() int {
+	if bctl.Conf.Proxy.PIDStateMaxAge > 0 {
+		return bctl.Conf.Proxy.PIDStateMaxAge
+	}
+
+	return DefaultPIDStateMaxAge
+}
+
+func (bctl *BucketCtl) pid_state_save_interval() int {
+	if bctl.Conf.Proxy.PIDStateSaveInterval > 0 {
+		return bctl.Conf.Proxy.PIDStateSaveInterval
+	}
+
+	return DefaultPIDStateSaveInterval
+}
+
+// host_metadata_key() returns metadata key for the data which is stored per proxy host
+func host_metadata_key(name string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("metadata: %s: hostname error: %v", name, err)
+		hostname = ""
+	}
+
+	return fmt.Sprintf("%s.%s", hostname, name)
+}
+
+// every proxy has its own view of the backends performance, thus state is stored per host
+func pid_state_key() string {
+	return host_metadata_key("PIDState")
+}
+
+func (bctl *BucketCtl) SavePIDState() (err error) {
+	states := bctl.PID.Copy(bctl.pid_state_max_age())
+	if len(states) == 0 {
+		return nil
+	}
+
+	key := pid_state_key()
+	err = bctl.UpdateMetadata(key, states)
+	if err != nil {
+		return
+	}
+
+	log.Printf("pid-state: %s: saved state of %d backends\n", key, len(states))
+	return
+}
+
+func (bctl *BucketCtl) RestorePIDState() (err error) {
+	key := pid_state_key()
+	max_age := bctl.pid_state_max_age()
+
+	states := make(map[string]*PIDState)
+	timestamp, err := bctl.ReadMetadata(key, &states)
+	if err != nil {
+		return
+	}
+
+	if timestamp < time.Now().Unix() - int64(max_age) {
+		log.Printf("pid-state: %s: saved state is too old: %s, max-age: %d seconds\n",
+			key, time.Unix(timestamp, 0).String(), max_age)
+		return
+	}
+
+	bctl.PID.Merge(states)
+
+	bctl.RLock()
+	defer bctl.RUnlock()
+
+	for _, b := range bctl.AllBuckets() {
+		for _, sg := range b.Group {
+			bctl.PID.Apply(sg, max_age)
+		}
+	}
+
+	log.Printf("pid-state: %s: restored state of %d backends saved at %s\n",
+		key, len(states), time.Unix(timestamp, 0).String())
+	return
+}
@@ -0,0 +1,231 @@
+package bucket
+
+import (
+	"fmt"
+	"github.com/DemonVex/backrunner/config"
+	"github.com/DemonVex/backrunner/errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// token_bucket allows @rate tokens per second with up to @rate * burst tokens accumulated while idle,
+// but not less than 1 token, otherwise rates below 1 per burst would never allow a request,
+// tokens can go negative, so request larger than the bucket size is allowed and next requests wait for it
+type token_bucket struct {
+	tokens		float64
+	last		time.Time
+}
+
+// wait() returns time needed to get at least one token with given rate and burst
+func (tb *token_bucket) wait(rate, burst float64, now time.Time) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+
+	size := math.Max(rate * burst, 1)
+	if tb.last.IsZero() {
+		tb.tokens = size
+	} else {
+		tb.tokens = math.Min(tb.tokens + now.Sub(tb.last).Seconds() * rate, size)
+	}
+	tb.last = now
+
+	if tb.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - tb.tokens) / rate * float64(time.Second))
+}
+
+func (tb *token_bucket) take(rate float64, n float64) {
+	if rate > 0 {
+		tb.tokens -= n
+	}
+}
+
+type limit_state struct {
+	requests	token_bucket
+	bytes		token_bucket
+
+	// number of throttled requests
+	throttled	uint64
+}
+
+type rate_limiter struct {
+	sync.Mutex
+
+	conf		config.RateLimitConfig
+	users		map[string]*limit_state
+	buckets		map[string]*limit_state
+}
+
+var limiter = &rate_limiter {
+	users:		make(map[string]*limit_state),
+	buckets:	make(map[string]*limit_state),
+}
+
+// SetRateLimits() sets per user and per bucket limits, token buckets of users and buckets are preserved
+func SetRateLimits(conf config.RateLimitConfig) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	limiter.conf = conf
+}
+
+func get_limit_state(m map[string]*limit_state, name string) *limit_state {
+	st, ok := m[name]
+	if !ok {
+		st = &limit_state {}
+		m[name] = st
+	}
+
+	return st
+}
+
+// ThrottleStat contains number of throttled requests of every user and bucket
+type ThrottleStat struct {
+	Users		map[string]uint64
+	Buckets		map[string]uint64
+}
+
+func NewThrottleStat() *ThrottleStat {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	ts := &ThrottleStat {
+		Users:		make(map[string]uint64),
+		Buckets:	make(map[string]uint64),
+	}
+
+	for name, st := range limiter.users {
+		if st.throttled != 0 {
+			ts.Users[name] = st.throttled
+		}
+	}
+	for name, st := range limiter.buckets {
+		if st.throttled != 0 {
+			ts.Buckets[name] = st.throttled
+		}
+	}
+
+	return ts
+}
+
+type rate_check struct {
+	kind		string
+	name		string
+	limit		config.RateLimit
+	st		*limit_state
+}
+
+// rate_checks_nolock() returns limits of the request of @user to @b bucket, unlimited user or bucket is skipped,
+// empty user (bucket without ACL) is only limited by bucket limits, @limiter must be locked
+func (b *Bucket) rate_checks_nolock(user string) []rate_check {
+	bucket_limit := limiter.conf.Bucket
+	if b.Meta.RateLimitRPS != 0 {
+		bucket_limit.RPS = float64(b.Meta.RateLimitRPS)
+	}
+	if b.Meta.RateLimitBPS != 0 {
+		bucket_limit.BPS = float64(b.Meta.RateLimitBPS)
+	}
+
+	checks := make([]rate_check, 0, 2)
+	if bucket_limit.RPS > 0 || bucket_limit.BPS > 0 {
+		checks = append(checks, rate_check {
+			kind:		"bucket",
+			name:		b.Name,
+			limit:		bucket_limit,
+			st:		get_limit_state(limiter.buckets, b.Name),
+		})
+	}
+
+	if len(user) != 0 {
+		user_limit := limiter.conf.User
+		if l, ok := limiter.conf.Users[user]; ok {
+			user_limit = l
+		}
+
+		if user_limit.RPS > 0 || user_limit.BPS > 0 {
+			checks = append(checks, rate_check {
+				kind:		"user",
+				name:		user,
+				limit:		user_limit,
+				st:		get_limit_state(limiter.users, user),
+			})
+		}
+	}
+
+	return checks
+}
+
+// check_rate_limit() charges request of @user to @b bucket against user and bucket limits,
+// request is throttled if either requests or bytes limit is exceeded, i.e. if previous transfers
+// have used more bandwidth than allowed, request body is charged in advance when its size is known,
+// other transferred data (downloads, chunked uploads) is charged by charge_bytes() when transfer completes
+func (b *Bucket) check_rate_limit(r *http.Request, user string) error {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	burst := limiter.conf.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+
+	checks := b.rate_checks_nolock(user)
+
+	size := float64(0)
+	if r.ContentLength > 0 {
+		size = float64(r.ContentLength)
+	}
+
+	// request is charged only if all limits allow it
+	now := time.Now()
+	for _, ch := range checks {
+		wait := ch.st.requests.wait(ch.limit.RPS, burst, now)
+		if w := ch.st.bytes.wait(ch.limit.BPS, burst, now); w > wait {
+			wait = w
+		}
+
+		if wait > 0 {
+			ch.st.throttled++
+
+			retry_after := int(math.Ceil(wait.Seconds()))
+			return errors.NewThrottleError(r.URL.String(),
+				fmt.Sprintf("%s '%s' has exceeded rate limit: rps: %.1f, bps: %.1f, retry after %d seconds",
+					ch.kind, ch.name, ch.limit.RPS, ch.limit.BPS, retry_after),
+				retry_after)
+		}
+	}
+
+	for _, ch := range checks {
+		ch.st.requests.take(ch.limit.RPS, 1)
+		ch.st.bytes.take(ch.limit.BPS, size)
+	}
+
+	return nil
+}
+
+// charge_bytes() charges @size bytes transferred by the request of @user to @b bucket against bandwidth limits,
+// they are not checked, the next request waits until bandwidth is available
+func (b *Bucket) charge_bytes(user string, size uint64) {
+	if size == 0 {
+		return
+	}
+
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	burst := limiter.conf.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+
+	now := time.Now()
+	for _, ch := range b.rate_checks_nolock(user) {
+		// refill tokens up to now before they are taken
+		ch.st.bytes.wait(ch.limit.BPS, burst, now)
+		ch.st.bytes.take(ch.limit.BPS, float64(size))
+	}
+}
@@ -0,0 +1,160 @@
+package bucket
+
+import (
+	"github.com/DemonVex/backrunner/config"
+	"github.com/DemonVex/backrunner/errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRate(t *testing.T) {
+	var tb token_bucket
+	now := time.Unix(1500000000, 0)
+
+	// the whole burst is available right away
+	for i := 0; i < 10; i++ {
+		if w := tb.wait(10, 1, now); w != 0 {
+			t.Fatalf("request %d: wait: %s, must be 0", i, w.String())
+		}
+		tb.take(10, 1)
+	}
+
+	if w := tb.wait(10, 1, now); w != 100 * time.Millisecond {
+		t.Fatalf("wait after burst: %s, must be 100ms", w.String())
+	}
+
+	// tokens are refilled at given rate, but not above bucket size
+	now = now.Add(500 * time.Millisecond)
+	if w := tb.wait(10, 1, now); w != 0 || tb.tokens != 5 {
+		t.Fatalf("refill: wait: %s, tokens: %f, must be 0 and 5", w.String(), tb.tokens)
+	}
+
+	now = now.Add(time.Hour)
+	if w := tb.wait(10, 1, now); w != 0 || tb.tokens != 10 {
+		t.Fatalf("idle refill: wait: %s, tokens: %f, must be 0 and 10", w.String(), tb.tokens)
+	}
+}
+
+func TestTokenBucketSlowRate(t *testing.T) {
+	var tb token_bucket
+	now := time.Unix(1500000000, 0)
+
+	// bucket holds at least 1 token even if rate * burst is less than 1
+	if w := tb.wait(0.5, 1, now); w != 0 {
+		t.Fatalf("first request: wait: %s, must be 0", w.String())
+	}
+	tb.take(0.5, 1)
+
+	if w := tb.wait(0.5, 1, now); w != 2 * time.Second {
+		t.Fatalf("second request: wait: %s, must be 2s", w.String())
+	}
+}
+
+func TestTokenBucketLargeRequest(t *testing.T) {
+	var tb token_bucket
+	now := time.Unix(1500000000, 0)
+
+	// request larger than the bucket is allowed, next requests wait until debt is repaid
+	if w := tb.wait(1, 1, now); w != 0 {
+		t.Fatalf("large request: wait: %s, must be 0", w.String())
+	}
+	tb.take(1, 3)
+
+	if w := tb.wait(1, 1, now); w != 3 * time.Second {
+		t.Fatalf("request after large one: wait: %s, must be 3s", w.String())
+	}
+}
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	var tb token_bucket
+	now := time.Unix(1500000000, 0)
+
+	for i := 0; i < 100; i++ {
+		if w := tb.wait(0, 1, now); w != 0 {
+			t.Fatalf("zero rate must not limit requests, wait: %s", w.String())
+		}
+		tb.take(0, 1)
+	}
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	SetRateLimits(config.RateLimitConfig {
+		User:		config.RateLimit{RPS: 1},
+		Users:		map[string]config.RateLimit {
+			"fast":		config.RateLimit{RPS: 100},
+		},
+	})
+	defer func() {
+		limiter.Lock()
+		limiter.conf = config.RateLimitConfig{}
+		limiter.users = make(map[string]*limit_state)
+		limiter.buckets = make(map[string]*limit_state)
+		limiter.Unlock()
+	}()
+
+	b := NewBucket("b1")
+	req := httptest.NewRequest("GET", "/get/b1/key", nil)
+
+	if err := b.check_rate_limit(req, "slow"); err != nil {
+		t.Fatalf("first request: unexpected error: %v", err)
+	}
+
+	err := b.check_rate_limit(req, "slow")
+	if err == nil {
+		t.Fatalf("second request has not been throttled")
+	}
+	if errors.ErrorStatus(err) != http.StatusTooManyRequests || errors.ErrorRetryAfter(err) != 1 {
+		t.Fatalf("throttle error: status: %d, retry-after: %d, must be %d and 1",
+			errors.ErrorStatus(err), errors.ErrorRetryAfter(err), http.StatusTooManyRequests)
+	}
+
+	// per user limit overrides default one, bucket itself is not limited
+	for i := 0; i < 10; i++ {
+		if err := b.check_rate_limit(req, "fast"); err != nil {
+			t.Fatalf("request %d of user with its own limit: unexpected error: %v", i, err)
+		}
+	}
+
+	st := NewThrottleStat()
+	if st.Users["slow"] != 1 || len(st.Buckets) != 0 {
+		t.Fatalf("invalid throttle stat: %+v", st)
+	}
+}
+
+func TestChargeBytes(t *testing.T) {
+	SetRateLimits(config.RateLimitConfig {
+		User:		config.RateLimit{BPS: 1000},
+	})
+	defer func() {
+		limiter.Lock()
+		limiter.conf = config.RateLimitConfig{}
+		limiter.users = make(map[string]*limit_state)
+		limiter.buckets = make(map[string]*limit_state)
+		limiter.Unlock()
+	}()
+
+	b := NewBucket("b1")
+	req := httptest.NewRequest("GET", "/get/b1/key", nil)
+
+	if err := b.check_rate_limit(req, "reader"); err != nil {
+		t.Fatalf("first download: unexpected error: %v", err)
+	}
+
+	// downloaded data is charged after transfer, the next request waits until bandwidth is available
+	b.charge_bytes("reader", 3000)
+
+	err := b.check_rate_limit(req, "reader")
+	if err == nil {
+		t.Fatalf("download after large one has not been throttled")
+	}
+	if retry_after := errors.ErrorRetryAfter(err); retry_after < 2 || retry_after > 3 {
+		t.Fatalf("retry-after: %d, must be about 3 seconds", retry_after)
+	}
+
+	// other users are not affected
+	if err := b.check_rate_limit(req, "other"); err != nil {
+		t.Fatalf("other user: unexpected error: %v", err)
+	}
+}
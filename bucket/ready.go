@@ -0,0 +1,152 @@
+package bucket
+
+import (
+	"fmt"
+	"github.com/bioothod/elliptics-go/elliptics"
+	"time"
+)
+
+// key used to check whether buckets are suitable for upload, it selects backends like any other key
+const ReadyCheckKey string = "readyz"
+
+type ReadyCheck struct {
+	Name			string
+	OK			bool
+	Message			string
+
+	// proxy is not ready if any critical check fails
+	Critical		bool
+}
+
+type ReadyReply struct {
+	Ready			bool
+	Time			string
+	Checks			[]*ReadyCheck
+}
+
+func NewReadyReply() *ReadyReply {
+	return &ReadyReply {
+		Ready:		true,
+		Time:		time.Now().String(),
+		Checks:		make([]*ReadyCheck, 0),
+	}
+}
+
+// Add() appends check result, @err is nil if check has passed
+func (r *ReadyReply) Add(name string, critical bool, err error, message string) {
+	ch := &ReadyCheck {
+		Name:		name,
+		OK:		err == nil,
+		Message:	message,
+		Critical:	critical,
+	}
+
+	if err != nil {
+		ch.Message = err.Error()
+		if critical {
+			r.Ready = false
+		}
+	}
+
+	r.Checks = append(r.Checks, ch)
+}
+
+func (bctl *BucketCtl) ready_min_writable_buckets() int {
+	if bctl.Conf.Proxy.ReadyMinWritableBuckets > 0 {
+		return bctl.Conf.Proxy.ReadyMinWritableBuckets
+	}
+
+	return 1
+}
+
+// metadata_lookup() looks up @key in metadata groups, it is the cheapest real request
+// which shows that proxy can talk to the storage
+func metadata_lookup(ms *elliptics.Session, key string) (err error) {
+	ms.SetNamespace(BucketNamespace)
+
+	err = fmt.Errorf("%s: metadata lookup returned nothing", key)
+	found := false
+	for l := range ms.Lookup(key) {
+		if l.Error() == nil {
+			found = true
+			continue
+		}
+
+		err = fmt.Errorf("%s: metadata lookup failed: %v", key, l.Error())
+	}
+
+	if found {
+		return nil
+	}
+
+	return err
+}
+
+// Ready() checks metadata groups availability, elliptics connectivity, statistics freshness, number of buckets suitable for upload
+// and config reload status
+func (bctl *BucketCtl) Ready() *ReadyReply {
+	r := NewReadyReply()
+
+	bctl.RLock()
+	stat_error := bctl.StatError
+	stat_groups := bctl.StatGroups
+	stat_time := bctl.StatTime
+	max_age := bctl.stat_max_age()
+	min_buckets := bctl.ready_min_writable_buckets()
+	config_error := bctl.ConfigError
+	config_error_time := bctl.ConfigErrorTime
+
+	// bucket list key is optional, metadata of any known bucket is looked up when it is not set
+	probe := bctl.Conf.Elliptics.BucketList
+	if len(probe) == 0 {
+		if buckets := bctl.AllBuckets(); len(buckets) != 0 {
+			probe = buckets[0].Name
+		}
+	}
+	bctl.RUnlock()
+
+	s, err := bctl.e.MetadataSession()
+	if err != nil {
+		r.Add("elliptics", true, fmt.Errorf("could not create metadata session: %v", err), "")
+		return r
+	}
+	defer s.Delete()
+
+	if len(probe) != 0 {
+		r.Add("metadata", true, metadata_lookup(s, probe), fmt.Sprintf("key: %s", probe))
+	} else {
+		r.Add("metadata", false, nil, "skipped: there is neither bucket list key nor buckets to look up")
+	}
+
+	if len(stat_error) != 0 {
+		err = fmt.Errorf("statistics update failed: %s", stat_error)
+	} else if stat_groups == 0 {
+		err = fmt.Errorf("there are no groups in statistics, proxy is not connected to any storage node")
+	}
+	r.Add("elliptics", true, err, fmt.Sprintf("groups: %d", stat_groups))
+
+	age := time.Since(stat_time)
+	err = nil
+	if age > max_age {
+		err = fmt.Errorf("statistics is stale: updated at %s, age: %s, max age: %s",
+			stat_time.String(), age.String(), max_age.String())
+	}
+	r.Add("stats", true, err, fmt.Sprintf("age: %s, max age: %s", age.String(), max_age.String()))
+
+	params := bctl.pain_params()
+	candidates := len(SelectionCandidates(bctl.bucket_pains(s, ReadyCheckKey, 0, params), params))
+	err = nil
+	if candidates < min_buckets {
+		err = fmt.Errorf("writable buckets: %d, must be at least %d", candidates, min_buckets)
+	}
+	r.Add("writable-buckets", true, err, fmt.Sprintf("writable buckets: %d", candidates))
+
+	// the last known good config is still used when reload fails, so it does not make proxy unready
+	err = nil
+	if len(config_error) != 0 {
+		err = fmt.Errorf("config reload failed at %s: %s", config_error_time.String(), config_error)
+	}
+	r.Add("config", false, err, "")
+
+	return r
+}
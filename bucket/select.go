@@ -0,0 +1,356 @@
+package bucket
+
+import (
+	"fmt"
+	"github.com/bioothod/elliptics-go/elliptics"
+	"math/rand"
+)
+
+// PainParams contains free space ratios and pains used to select bucket for upload,
+// proxy always uses pain constants, offline simulator may tune them
+type PainParams struct {
+	// free space ratios, see FreeSpaceRatioSoft and FreeSpaceRatioHard in proxy config
+	FreeSpaceRatioSoft	float64
+	FreeSpaceRatioHard	float64
+
+	NoFreeSpaceSoft		float64
+	NoFreeSpaceHard		float64
+	StatRO			float64
+	WriteError		float64
+	NoStats			float64
+	StatError		float64
+	NoGroup			float64
+	Discrepancy		float64
+}
+
+func NewPainParams(soft, hard float64) *PainParams {
+	return &PainParams {
+		FreeSpaceRatioSoft:	soft,
+		FreeSpaceRatioHard:	hard,
+
+		NoFreeSpaceSoft:	PainNoFreeSpaceSoft,
+		NoFreeSpaceHard:	PainNoFreeSpaceHard,
+		StatRO:			PainStatRO,
+		WriteError:		BucketWriteErrorPain,
+		NoStats:		PainNoStats,
+		StatError:		PainStatError,
+		NoGroup:		PainNoGroup,
+		Discrepancy:		PainDiscrepancy,
+	}
+}
+
+// GroupPain describes how given group (actually address+backend in this group, which hosts the key)
+// contributes into the bucket pain
+type GroupPain struct {
+	Group		uint32			`json:"group"`
+	Backend		string			`json:"backend,omitempty"`
+
+	FreeRate	float64			`json:"free-rate"`
+	FreeSpacePain	float64			`json:"free-space-pain"`
+	PIDPain		float64			`json:"pid-pain"`
+
+	// pain for read-only backends, backends with broken or without statistics
+	Penalty		float64			`json:"penalty"`
+	Reason		string			`json:"reason,omitempty"`
+
+	Pain		float64			`json:"pain"`
+	Success		bool			`json:"success"`
+
+	// whether free space and PID pains have been calculated,
+	// they are not when backend has been penalized
+	calculated	bool
+}
+
+// NewGroupPain() calculates pain of writing @content_length bytes into given backend
+// @st can be nil, this means there are no statistics for address+backend which hosts the key
+func NewGroupPain(group_id uint32, st *elliptics.StatBackend, content_length uint64, params *PainParams) *GroupPain {
+	gp := &GroupPain {
+		Group:		group_id,
+	}
+
+	penalty := func(pain float64, reason string) *GroupPain {
+		gp.Penalty = pain
+		gp.Reason = reason
+		gp.Pain = pain
+		return gp
+	}
+
+	if st == nil {
+		// there is no statistics for given address+backend, which should host our data
+		// do not allow to write into the bucket which contains given address+backend
+		return penalty(params.NoStats, "there are no statistics for backend")
+	}
+
+	gp.Backend = st.Ab.String()
+
+	if st.RO {
+		return penalty(params.StatRO, "backend is in read-only mode")
+	}
+
+	if st.Error.Code != 0 {
+		return penalty(params.StatError, fmt.Sprintf("backend statistics contain error: %d", st.Error.Code))
+	}
+
+	// this is an empty stat structure
+	if st.VFS.TotalSizeLimit == 0 || st.VFS.Total == 0 {
+		return penalty(params.NoStats, "backend statistics are empty")
+	}
+
+	gp.calculated = true
+	soft := params.FreeSpaceRatioSoft
+	hard := params.FreeSpaceRatioHard
+
+	gp.FreeRate = FreeSpaceRatio(st, content_length)
+	if gp.FreeRate <= hard {
+		gp.FreeSpacePain = params.NoFreeSpaceHard
+		gp.Reason = fmt.Sprintf("free space rate %f is not higher than hard limit %f", gp.FreeRate, hard)
+	} else if gp.FreeRate <= soft {
+		free_space_pain := 1000.0 / (gp.FreeRate - hard)
+		gp.FreeSpacePain = params.NoFreeSpaceSoft + free_space_pain * 5
+		gp.Reason = fmt.Sprintf("free space rate %f is not higher than soft limit %f", gp.FreeRate, soft)
+	} else {
+		gp.Success = true
+
+		free_space_pain := 1000.0 / (gp.FreeRate - soft)
+		if free_space_pain >= params.NoFreeSpaceSoft {
+			free_space_pain = params.NoFreeSpaceSoft * 0.8
+		}
+
+		gp.FreeSpacePain = free_space_pain
+	}
+
+	gp.PIDPain = st.PIDPain()
+	gp.Pain = gp.FreeSpacePain + gp.PIDPain
+	return gp
+}
+
+// BackendFinder returns statistics of the address+backend in given group which hosts the key being uploaded
+type BackendFinder func(group_id uint32, sg *elliptics.StatGroup) (*elliptics.StatBackend, error)
+
+// BucketPain contains all components of the bucket pain used to select bucket for upload,
+// the lower the pain, the higher the probability to select given bucket
+type BucketPain struct {
+	Bucket		*Bucket			`json:"-"`
+	Name		string			`json:"bucket"`
+
+	Groups		[]*GroupPain		`json:"groups"`
+	SuccessGroups	[]uint32		`json:"success-groups"`
+	ErrorGroups	[]uint32		`json:"error-groups"`
+
+	// pain for bucket groups which are not present in statistics
+	NoGroupPain	float64			`json:"no-group-pain"`
+	DiscrepancyPain	float64			`json:"discrepancy-pain"`
+	Pain		float64			`json:"pain"`
+
+	// selection weight, only makes sense for buckets returned by SelectionCandidates()
+	Range		float64			`json:"-"`
+	Probability	float64			`json:"probability"`
+
+	// non-empty if bucket can not be selected for given upload
+	Excluded	string			`json:"excluded,omitempty"`
+}
+
+func NewBucketPain(b *Bucket, content_length uint64, params *PainParams, find BackendFinder) *BucketPain {
+	bp := &BucketPain {
+		Bucket:		b,
+		Name:		b.Name,
+		Groups:		make([]*GroupPain, 0, len(b.Group)),
+		SuccessGroups:	make([]uint32, 0),
+		ErrorGroups:	make([]uint32, 0),
+	}
+
+	for group_id, sg := range b.Group {
+		st, err := find(group_id, sg)
+		if err != nil {
+			st = nil
+		}
+
+		gp := NewGroupPain(group_id, st, content_length, params)
+		if err != nil {
+			gp.Reason = fmt.Sprintf("%s: %v", gp.Reason, err)
+		}
+		if gp.Success {
+			bp.SuccessGroups = append(bp.SuccessGroups, group_id)
+		} else {
+			bp.ErrorGroups = append(bp.ErrorGroups, group_id)
+		}
+
+		bp.Groups = append(bp.Groups, gp)
+		bp.Pain += gp.Pain
+	}
+
+	total_groups := len(bp.SuccessGroups) + len(bp.ErrorGroups)
+	diff := 0
+	if len(b.Meta.Groups) > total_groups {
+		diff += len(b.Meta.Groups) - total_groups
+	}
+
+	bp.NoGroupPain = float64(diff) * params.NoGroup
+	bp.Pain += bp.NoGroupPain
+
+	// calculate discrepancy pain:
+	// run over all address+backends in every group in given bucket,
+	// sum up number of live records
+	// set discrepancy as a maximum difference between number of records among all groups
+	var min_records uint64 = 1 << 31 - 1
+	var max_records uint64 = 0
+
+	records := make([]uint64, 0)
+	for _, sg := range b.Group {
+		var r uint64 = 0
+
+		for _, sb := range sg.Ab {
+			r += sb.VFS.RecordsTotal - sb.VFS.RecordsRemoved
+		}
+
+		records = append(records, r)
+	}
+
+	for _, r := range records {
+		if r < min_records {
+			min_records = r
+		}
+
+		if r > max_records {
+			max_records = r
+		}
+	}
+	bp.DiscrepancyPain = float64(max_records - min_records) * params.Discrepancy
+	bp.Pain += bp.DiscrepancyPain
+
+	return bp
+}
+
+func (bp *BucketPain) pid_pains() []float64 {
+	pains := make([]float64, 0, len(bp.Groups))
+	for _, gp := range bp.Groups {
+		if gp.calculated {
+			pains = append(pains, gp.PIDPain)
+		}
+	}
+
+	return pains
+}
+
+func (bp *BucketPain) free_rates() []float64 {
+	rates := make([]float64, 0, len(bp.Groups))
+	for _, gp := range bp.Groups {
+		if gp.calculated {
+			rates = append(rates, gp.FreeRate)
+		}
+	}
+
+	return rates
+}
+
+func (bp *BucketPain) String() string {
+	abs := make([]string, 0, len(bp.Groups))
+	for _, gp := range bp.Groups {
+		if len(gp.Backend) != 0 {
+			abs = append(abs, gp.Backend)
+		}
+	}
+
+	return fmt.Sprintf("{bucket: %s, success-groups: %v, error-groups: %v, groups: %v, abs: %v, pain: %f, pains: %v, free-rates: %v}",
+		bp.Name, bp.SuccessGroups, bp.ErrorGroups, bp.Bucket.Meta.Groups, abs, bp.Pain,
+		bp.pid_pains(), bp.free_rates())
+}
+
+// SelectionCandidates() marks buckets which can not be used for the upload,
+// calculates selection weights and probabilities of the remaining buckets and returns them
+func SelectionCandidates(pains []*BucketPain, params *PainParams) []*BucketPain {
+	stat := make([]*BucketPain, 0, len(pains))
+
+	for _, bp := range pains {
+		// do not even consider buckets without free space even in one group
+		if bp.Pain >= params.NoFreeSpaceHard {
+			bp.Excluded = fmt.Sprintf("pain %f is higher than hard limit %f", bp.Pain, params.NoFreeSpaceHard)
+			continue
+		}
+
+		if bp.Pain != 0 {
+			bp.Range = 1.0 / bp.Pain
+		} else {
+			bp.Range = 1.0
+		}
+
+		stat = append(stat, bp)
+	}
+
+	// there are no buckets suitable for this request
+	// either there is no space in either bucket, or there are no buckets at all
+	if len(stat) == 0 {
+		return stat
+	}
+
+	// get rid of buckets without free space if we do have other buckets
+	ok_buckets := 0
+	nospace_buckets := 0
+	for _, bp := range stat {
+		if bp.Pain < params.NoFreeSpaceSoft {
+			ok_buckets++
+		} else {
+			nospace_buckets++
+		}
+	}
+
+	if nospace_buckets != 0 && ok_buckets != 0 {
+		tmp := make([]*BucketPain, 0, ok_buckets)
+		for _, bp := range stat {
+			if bp.Pain < params.NoFreeSpaceSoft {
+				tmp = append(tmp, bp)
+			} else {
+				bp.Excluded = fmt.Sprintf("pain %f is higher than soft limit %f and there are buckets with free space",
+					bp.Pain, params.NoFreeSpaceSoft)
+			}
+		}
+
+		stat = tmp
+	}
+
+	var sum int64 = 0
+	for {
+		sum = 0
+		var multiple int64 = 10
+
+		for _, bp := range stat {
+			sum += int64(bp.Range)
+		}
+
+		if sum >= multiple {
+			break
+		} else {
+			for _, bp := range stat {
+				bp.Range *= float64(multiple)
+			}
+		}
+	}
+
+	for _, bp := range stat {
+		bp.Probability = float64(int64(bp.Range)) / float64(sum)
+	}
+
+	return stat
+}
+
+// SelectBucket() randomly selects bucket among candidates according to their weights
+func SelectBucket(stat []*BucketPain) *BucketPain {
+	if len(stat) == 0 {
+		return nil
+	}
+
+	var sum int64 = 0
+	for _, bp := range stat {
+		sum += int64(bp.Range)
+	}
+
+	r := rand.Int63n(sum)
+	for _, bp := range stat {
+		r -= int64(bp.Range)
+		if r <= 0 {
+			return bp
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package bucket
+
+import (
+	"testing"
+)
+
+func TestSelectionCandidatesParams(t *testing.T) {
+	pains := func() []*BucketPain {
+		return []*BucketPain {
+			&BucketPain{Name: "b1", Pain: 10},
+			&BucketPain{Name: "b2", Pain: 1000},
+			&BucketPain{Name: "b3", Pain: 100000},
+		}
+	}
+
+	// default pains allow all buckets
+	if stat := SelectionCandidates(pains(), NewPainParams(0.2, 0.1)); len(stat) != 3 {
+		t.Fatalf("default params: candidates: %d, must be 3", len(stat))
+	}
+
+	params := NewPainParams(0.2, 0.1)
+	params.NoFreeSpaceSoft = 100
+	params.NoFreeSpaceHard = 10000
+
+	all := pains()
+	stat := SelectionCandidates(all, params)
+	if len(stat) != 1 || stat[0].Name != "b1" || stat[0].Probability != 1 {
+		t.Fatalf("tuned params: candidates: %v, must be only b1", stat)
+	}
+	if len(all[1].Excluded) == 0 || len(all[2].Excluded) == 0 {
+		t.Fatalf("tuned params: buckets above soft and hard pains must be excluded: %+v, %+v", all[1], all[2])
+	}
+}
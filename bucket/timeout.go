@@ -0,0 +1,133 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"github.com/DemonVex/backrunner/errors"
+	"github.com/bioothod/elliptics-go/elliptics"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// client may limit the whole request by sending number of seconds in this header,
+// deadline can not exceed timeout configured for the operation, elliptics timeout of every transaction
+// of the request is lowered to the time left until the deadline
+const RequestTimeoutHeader string = "X-Request-Timeout"
+
+const (
+	TimeoutRead string		= "read"
+	TimeoutReadDefrag string	= "read-defrag"
+	TimeoutWrite string		= "write"
+	TimeoutLookup string		= "lookup"
+	TimeoutDelete string		= "delete"
+)
+
+// time given to elliptics to report its own timeout error before request context deadline expires
+const deadline_grace time.Duration = time.Second
+
+// default elliptics timeouts in seconds of data operations
+var DefaultTimeouts = map[string]int {
+	TimeoutRead:		30,
+	TimeoutReadDefrag:	90,
+	TimeoutWrite:		100,
+	TimeoutLookup:		40,
+	TimeoutDelete:		40,
+}
+
+// ValidTimeoutOperation() returns true if @op timeout can be set in bucket metadata
+func ValidTimeoutOperation(op string) bool {
+	_, ok := DefaultTimeouts[op]
+	return ok
+}
+
+// op_timeout() returns timeout of the operation: bucket metadata overrides proxy config which overrides defaults
+func (bctl *BucketCtl) op_timeout(bucket *Bucket, op string) time.Duration {
+	if t := bucket.Meta.Timeouts[op]; t != 0 {
+		return time.Duration(t) * time.Second
+	}
+
+	conf := 0
+	switch op {
+	case TimeoutRead:
+		conf = bctl.Conf.Proxy.Timeouts.Read
+	case TimeoutReadDefrag:
+		conf = bctl.Conf.Proxy.Timeouts.ReadDefrag
+	case TimeoutWrite:
+		conf = bctl.Conf.Proxy.Timeouts.Write
+	case TimeoutLookup:
+		conf = bctl.Conf.Proxy.Timeouts.Lookup
+	case TimeoutDelete:
+		conf = bctl.Conf.Proxy.Timeouts.Delete
+	}
+
+	if conf > 0 {
+		return time.Duration(conf) * time.Second
+	}
+
+	return time.Duration(DefaultTimeouts[op]) * time.Second
+}
+
+// client_deadline() returns context which expires when deadline requested by client in @RequestTimeoutHeader
+// header expires, deadline is capped by @timeout of the operation, @ctx is returned if there is no header
+func client_deadline(ctx context.Context, req *http.Request, timeout time.Duration) (context.Context, context.CancelFunc, error) {
+	hdr := req.Header.Get(RequestTimeoutHeader)
+	if len(hdr) == 0 {
+		return ctx, func() {}, nil
+	}
+
+	seconds, err := strconv.ParseFloat(hdr, 64)
+	if err != nil || seconds <= 0 {
+		return ctx, func() {}, errors.NewKeyError(req.URL.String(), http.StatusBadRequest,
+			fmt.Sprintf("invalid %s header '%s', must be positive number of seconds", RequestTimeoutHeader, hdr))
+	}
+
+	if client := time.Duration(seconds * float64(time.Second)); client < timeout {
+		timeout = client
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, nil
+}
+
+// session_timeout() applies client deadline (see client_deadline()) to the returned context,
+// lowers @timeout to the deadline of that context and sets it to the elliptics session as per-transaction timeout,
+// it is used for streaming reads and writes and bulk deletes, which are only limited as a whole by client deadline
+func (bctl *BucketCtl) session_timeout(ctx context.Context, s *elliptics.Session, req *http.Request,
+		timeout time.Duration) (context.Context, context.CancelFunc, time.Duration, error) {
+	ctx, cancel, err := client_deadline(ctx, req, timeout)
+	if err != nil {
+		return ctx, cancel, 0, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < timeout {
+			timeout = left
+		}
+	}
+
+	// elliptics timeout has seconds granularity
+	timeout = time.Duration(math.Max(1, math.Ceil(timeout.Seconds()))) * time.Second
+	s.SetTimeout(int(timeout.Seconds()))
+
+	return ctx, cancel, timeout, nil
+}
+
+// with_timeout() sets session timeout like session_timeout() and returns context which expires with
+// the operation, it is only used for single transaction operations like lookup or delete,
+// elliptics fails the operation itself and its error is accounted in backend health,
+// context deadline is a backstop which aborts the request if elliptics does not complete in time
+func (bctl *BucketCtl) with_timeout(ctx context.Context, s *elliptics.Session, req *http.Request,
+		timeout time.Duration) (context.Context, context.CancelFunc, error) {
+	ctx, client_cancel, timeout, err := bctl.session_timeout(ctx, s, req, timeout)
+	if err != nil {
+		return ctx, client_cancel, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout + deadline_grace)
+	return ctx, func() {
+		cancel()
+		client_cancel()
+	}, nil
+}
@@ -0,0 +1,58 @@
+package bucket
+
+import (
+	"context"
+	"github.com/DemonVex/backrunner/errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientDeadline(t *testing.T) {
+	check := func(hdr string, timeout time.Duration, expected time.Duration) {
+		req := httptest.NewRequest("GET", "/get/b1/key", nil)
+		if len(hdr) != 0 {
+			req.Header.Set(RequestTimeoutHeader, hdr)
+		}
+
+		ctx, cancel, err := client_deadline(context.Background(), req, timeout)
+		defer cancel()
+		if err != nil {
+			t.Fatalf("header '%s': unexpected error: %v", hdr, err)
+		}
+
+		deadline, ok := ctx.Deadline()
+		if expected == 0 {
+			if ok {
+				t.Fatalf("header '%s': request without header must not have deadline", hdr)
+			}
+			return
+		}
+
+		if !ok {
+			t.Fatalf("header '%s': there is no deadline", hdr)
+		}
+		if left := time.Until(deadline); left > expected || left < expected - time.Second {
+			t.Fatalf("header '%s': deadline in %s, must be in %s", hdr, left.String(), expected.String())
+		}
+	}
+
+	check("", 30 * time.Second, 0)
+	check("5", 30 * time.Second, 5 * time.Second)
+	check("0.5", 30 * time.Second, 500 * time.Millisecond)
+
+	// client can not extend operation timeout
+	check("100", 30 * time.Second, 30 * time.Second)
+
+	for _, hdr := range []string{"0", "-1", "abc"} {
+		req := httptest.NewRequest("GET", "/get/b1/key", nil)
+		req.Header.Set(RequestTimeoutHeader, hdr)
+
+		_, cancel, err := client_deadline(context.Background(), req, 30 * time.Second)
+		cancel()
+		if errors.ErrorStatus(err) != http.StatusBadRequest {
+			t.Errorf("header '%s': error: %v, must be bad request", hdr, err)
+		}
+	}
+}
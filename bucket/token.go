@@ -0,0 +1,117 @@
+package bucket
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// ACL tokens are stored in plain text
+	BucketMetadataVersionPlain int32	= 1
+
+	// ACL tokens are encrypted with the key set by SetTokenKey()
+	BucketMetadataVersionEncrypted int32	= 2
+
+	TokenPlaceholder string			= "<secret>"
+)
+
+var token_key struct {
+	sync.RWMutex
+	aead		cipher.AEAD
+}
+
+// SetTokenKey() sets the key used to encrypt ACL tokens in the bucket metadata,
+// AES-256 key is derived from @key, empty key disables encryption
+func SetTokenKey(key string) error {
+	var aead cipher.AEAD
+
+	if len(key) != 0 {
+		sum := sha256.Sum256([]byte(key))
+		block, err := aes.NewCipher(sum[:])
+		if err != nil {
+			return err
+		}
+
+		aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+	}
+
+	token_key.Lock()
+	defer token_key.Unlock()
+
+	token_key.aead = aead
+	return nil
+}
+
+func get_token_key() cipher.AEAD {
+	token_key.RLock()
+	defer token_key.RUnlock()
+
+	return token_key.aead
+}
+
+// DefaultMetadataVersion() returns version used for the new bucket metadata
+func DefaultMetadataVersion() int32 {
+	if get_token_key() != nil {
+		return BucketMetadataVersionEncrypted
+	}
+
+	return BucketMetadataVersionPlain
+}
+
+// encrypt_token() encrypts token, user name is authenticated together with token,
+// thus encrypted token can not be copied into other user's ACL
+func encrypt_token(user, token string) (string, error) {
+	aead := get_token_key()
+	if aead == nil {
+		return "", fmt.Errorf("token key is not set")
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(token), []byte(user))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decrypt_token(user, enc string) (string, error) {
+	aead := get_token_key()
+	if aead == nil {
+		return "", fmt.Errorf("token key is not set")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("encrypted token is too short")
+	}
+
+	token, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(user))
+	if err != nil {
+		return "", err
+	}
+
+	return string(token), nil
+}
+
+func redact_token(token string) string {
+	if len(token) == 0 {
+		return ""
+	}
+
+	return TokenPlaceholder
+}
@@ -0,0 +1,175 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultReloadInterval int = 60
+
+type Pair struct {
+	CertFile		string
+	KeyFile			string
+}
+
+type loaded_cert struct {
+	pair			Pair
+	cert			*tls.Certificate
+	names			[]string
+
+	// modification times of the certificate and key files when they were loaded
+	cert_mtime		time.Time
+	key_mtime		time.Time
+}
+
+// Store contains server certificates which are reloaded from files without server restart,
+// certificate is selected by SNI server name, the first certificate is used by default
+type Store struct {
+	sync.RWMutex
+
+	pairs			[]Pair
+	certs			[]*loaded_cert
+}
+
+func mtime(file string) time.Time {
+	st, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return st.ModTime()
+}
+
+func load(pair Pair) (*loaded_cert, error) {
+	lc := &loaded_cert {
+		pair:		pair,
+		cert_mtime:	mtime(pair.CertFile),
+		key_mtime:	mtime(pair.KeyFile),
+	}
+
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cert: %s, key: %s: %v", pair.CertFile, pair.KeyFile, err)
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("cert: %s: %v", pair.CertFile, err)
+	}
+
+	lc.cert = &cert
+	lc.names = append(lc.names, cert.Leaf.DNSNames...)
+	if len(cert.Leaf.Subject.CommonName) != 0 {
+		lc.names = append(lc.names, cert.Leaf.Subject.CommonName)
+	}
+
+	return lc, nil
+}
+
+// NewStore() loads all certificates, it fails if any of them can not be loaded
+func NewStore(pairs []Pair) (*Store, error) {
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("there are no certificates")
+	}
+
+	st := &Store {
+		pairs:		pairs,
+		certs:		make([]*loaded_cert, 0, len(pairs)),
+	}
+
+	for _, pair := range pairs {
+		lc, err := load(pair)
+		if err != nil {
+			return nil, err
+		}
+
+		st.certs = append(st.certs, lc)
+	}
+
+	return st, nil
+}
+
+// Reload() rereads certificates, when @force is false only changed files are reread,
+// certificate which can not be loaded is not replaced
+func (st *Store) Reload(force bool) (err error) {
+	st.RLock()
+	old := st.certs
+	st.RUnlock()
+
+	certs := make([]*loaded_cert, 0, len(old))
+	for _, lc := range old {
+		if !force && lc.cert_mtime.Equal(mtime(lc.pair.CertFile)) && lc.key_mtime.Equal(mtime(lc.pair.KeyFile)) {
+			certs = append(certs, lc)
+			continue
+		}
+
+		nc, e := load(lc.pair)
+		if e != nil {
+			log.Printf("certs: could not reload certificate, using old one: %v\n", e)
+			err = e
+			certs = append(certs, lc)
+			continue
+		}
+
+		log.Printf("certs: reloaded certificate: %s, names: %v, expires: %s\n",
+			nc.pair.CertFile, nc.names, nc.cert.Leaf.NotAfter.String())
+		certs = append(certs, nc)
+	}
+
+	st.Lock()
+	st.certs = certs
+	st.Unlock()
+
+	return
+}
+
+// Watch() checks certificate files every @interval and reloads changed ones
+func (st *Store) Watch(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			st.Reload(false)
+		}
+	}()
+}
+
+func match_name(pattern, name string) bool {
+	pattern = strings.ToLower(pattern)
+
+	if pattern == name {
+		return true
+	}
+
+	// wildcard matches exactly one leftmost label
+	if strings.HasPrefix(pattern, "*.") {
+		idx := strings.Index(name, ".")
+		return idx > 0 && name[idx:] == pattern[1:]
+	}
+
+	return false
+}
+
+// GetCertificate() selects certificate by SNI server name, it is used as tls.Config.GetCertificate
+func (st *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	st.RLock()
+	defer st.RUnlock()
+
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if len(name) != 0 {
+		for _, lc := range st.certs {
+			for _, n := range lc.names {
+				if match_name(n, name) {
+					return lc.cert, nil
+				}
+			}
+		}
+	}
+
+	return st.certs[0].cert, nil
+}
@@ -108,26 +108,124 @@ func (config *EllipticsServerConfig) Load(file string) (err error) {
 
 type EllipticsClientConfig struct {
 	LogFile string				`json:"log-file"`
-	LogLevel string				`json:"log-level"`
+	LogLevel string				`json:"log-level" restart:"true"`
 	LogPrefix string			`json:"log-prefix"`
-	Remote []string				`json:"remote"`
-	MetadataGroups []uint32			`json:"metadata-groups"`
+	Remote []string				`json:"remote" restart:"true"`
+	MetadataGroups []uint32			`json:"metadata-groups" restart:"true"`
 
 	// when present, backrunner reads its proxy config from elliptics from metadata groups
 	BackrunnerConfig string			`json:"backrunner-config-key"`
 
 	// when present, backrunner reads list of buckets from elliptics
 	BucketList string			`json:"bucket-list-key"`
+
+	// when set, ACL tokens in bucket metadata are encrypted with the key derived from @TokenKey,
+	// @TokenKeyFile is a file which contains the key
+	TokenKey string				`json:"token-key" secret:"true"`
+	TokenKeyFile string			`json:"token-key-file"`
+}
+
+type JWTKey struct {
+	// key is only used for tokens with the same 'kid' header, empty id matches tokens without 'kid'
+	ID string				`json:"id"`
+
+	// HS256, RS256 or ES256
+	Alg string				`json:"alg"`
+
+	// HS256 key file contains shared secret, RS256 and ES256 key files contain PEM encoded public key or certificate
+	File string				`json:"file"`
+}
+
+type JWTConfig struct {
+	Keys []JWTKey				`json:"keys"`
+
+	// when set, token must contain the same 'iss' claim and this value in 'aud' claim
+	Issuer string				`json:"issuer"`
+	Audience string				`json:"audience"`
+
+	// claim which contains bucket ACL user name, 'sub' by default
+	UserClaim string			`json:"user-claim"`
+
+	// optional claim which contains number or list of flag names ("write", "admin"),
+	// it limits flags of the user's bucket ACL, 'flags' by default
+	FlagsClaim string			`json:"flags-claim"`
+
+	// allowed clock skew in seconds when 'exp' and 'nbf' claims are checked
+	Leeway int				`json:"leeway"`
+
+	// tokens must contain 'exp' claim, when set, it must not be more than @MaxLifetime seconds in the future
+	MaxLifetime int				`json:"max-lifetime"`
+}
+
+type RateLimit struct {
+	// requests per second and transferred (uploaded and downloaded) bytes per second, zero means unlimited
+	RPS float64				`json:"rps"`
+	BPS float64				`json:"bps"`
+}
+
+type RateLimitConfig struct {
+	// default limits of every bucket ACL user and every bucket,
+	// limits set in bucket metadata override @Bucket
+	User RateLimit				`json:"user"`
+	Bucket RateLimit			`json:"bucket"`
+
+	// per user limits which override @User
+	Users map[string]RateLimit		`json:"users"`
+
+	// token bucket size in seconds, i.e. for how long client which was idle may exceed the rate,
+	// zero means 1 second
+	Burst float64				`json:"burst"`
+}
+
+type ConcurrencyLimit struct {
+	// maximum number of requests processed at once, zero means unlimited
+	MaxInFlight int				`json:"max-in-flight"`
+
+	// maximum number of requests waiting for processing slot, requests above it are rejected immediately
+	MaxQueue int				`json:"max-queue"`
+
+	// maximum time in milliseconds request waits in the queue, zero means 1 second
+	QueueTimeout int			`json:"queue-timeout"`
+}
+
+type Timeouts struct {
+	// elliptics operation timeouts in seconds, zero means default,
+	// data operation timeouts can be overridden in bucket metadata and lowered by client with X-Request-Timeout header
+	Read int				`json:"read"`
+
+	// read timeout used when all replicas of the bucket are being defragmented
+	ReadDefrag int				`json:"read-defrag"`
+
+	Write int				`json:"write"`
+	Lookup int				`json:"lookup"`
+	Delete int				`json:"delete"`
+
+	// statistics and metadata sessions timeouts, zero metadata timeout means elliptics node default
+	Stat int				`json:"stat"`
+	Metadata int				`json:"metadata"`
+}
+
+// interval in seconds between defragmentation scans
+const DefragScanInterval int = 31
+
+type CertPair struct {
+	CertFile string				`json:"cert_file"`
+	KeyFile string				`json:"key_file"`
 }
 
 type ProxyClientConfig struct {
 	// address to listen for incomming connections
 	// if it is empty, TLS connections can still be accepted (see below @HTTPSAddress parameter)
-	Address string				`json:"address"`
+	Address string				`json:"address" restart:"true"`
 
 	// http connection timeout in seconds
 	IdleTimeout int				`json:"idle-timeout"`
 
+	// on SIGTERM or drain request proxy fails readiness checks for @DrainDelay seconds,
+	// then stops accepting connections and waits up to @ShutdownTimeout seconds for in-flight requests
+	DrainDelay int				`json:"drain-delay"`
+	ShutdownTimeout int			`json:"shutdown-timeout"`
+
 	// minimum available free space ratio of bucket to be writable
 	// but if there are no other options, proxy will select among buckets,
 	// which have more than hard ratio limit but less than soft ratio limit of free space
@@ -142,12 +240,51 @@ type ProxyClientConfig struct {
 	// bucket statistics update time in seconds
 	BucketStatUpdateInterval int		`json:"bucket-stat-update-interval"`
 
+	// statistics older than @StatMaxAge seconds are stale, zero means 3 statistics update intervals,
+	// it must be set when @BucketStatUpdateInterval is zero
+	StatMaxAge int				`json:"stat-max-age"`
+
+	// proxy is not ready if there are less than @ReadyMinWritableBuckets buckets suitable for upload,
+	// zero means 1
+	ReadyMinWritableBuckets int		`json:"ready-min-writable-buckets"`
+
+	// elliptics operation timeouts
+	Timeouts Timeouts			`json:"timeouts"`
+
+	// requests which exceed per user or per bucket limits are rejected with http.StatusTooManyRequests
+	RateLimit RateLimitConfig		`json:"rate-limit"`
+
+	// handler name ("upload", "get" and so on) -> limit of the concurrently processed requests,
+	// overloaded handler rejects requests with http.StatusServiceUnavailable
+	ConcurrencyLimits map[string]ConcurrencyLimit	`json:"concurrency-limits"`
+
+	// write PID controller state of every backend is saved into metadata groups once per @PIDStateSaveInterval seconds,
+	// it is restored at start (and when statistics update replaces backend objects)
+	// if it is not older than @PIDStateMaxAge seconds, zero values mean defaults
+	PIDStateSaveInterval int		`json:"pid-state-save-interval"`
+	PIDStateMaxAge int			`json:"pid-state-max-age"`
+
+	// read requests prefer healthy replicas: backend is read only after healthy ones if its moving average
+	// of the read error ratio is higher than @ReadErrorRateLimit or if its read pain (latency per byte and errors)
+	// is more than @ReadLatencyRatioLimit times higher than the best one, zero values mean defaults
+	ReadErrorRateLimit float64		`json:"read-error-rate-limit"`
+	ReadLatencyRatioLimit float64		`json:"read-latency-ratio-limit"`
+
 	// all redirect requests will be redirected to following port, it port is outside of allowed [0, 65536) range,
 	// redirect requests will return http.StatusServiceUnavailable
 	RedirectPort int			`json:"redirect-port"`
 
 	// all redirect replies will contain @auth.AuthHeaderStr 'Authorization' header generated with given token
-	RedirectToken string
+	RedirectToken string			`json:"redirect-token" secret:"true"`
+
+	// deprecated name of @RedirectToken used by old configs, it is moved into @RedirectToken when config is loaded
+	RedirectTokenDeprecated string		`json:"RedirectToken" secret:"true"`
+
+	// when set, @RedirectToken is read from this file
+	RedirectTokenFile string		`json:"redirect-token-file"`
+
+	// 'Authorization: Bearer <jwt>' tokens signed with these keys are accepted as an alternative to hmac signatures
+	JWT JWTConfig				`json:"jwt"`
 
 	// number of seconds redirect signature is valid since @Signtime, streaming module will not return data if timeout has passed
 	RedirectSignatureTimeout int		`json:"redirect-signature-timeout"`
@@ -168,12 +305,32 @@ type ProxyClientConfig struct {
 	// only run defragmentation in backends which will free at least @DefragRemovedSpaceLimit byte ratio
 	DefragRemovedSpaceLimit float64		`json:"defrag-removed-space-limit"`
 
-	// maximum number of buckets where defragmentation is allowed to run in parallel
+	// maximum number of buckets where defragmentation is allowed to run in parallel, it must be positive
 	DefragMaxBuckets int			`json:"defrag-max-buckets"`
 
-	// maximum number of backends being defragmented on any single server node
+	// maximum number of backends being defragmented on any single server node, zero disables defragmentation
 	DefragMaxBackendsPerServer int		`json:"defrag-max-backends-per-server"`
 
+	// maximum number of backends being defragmented in the whole cluster, zero means no limit
+	DefragMaxBackends int			`json:"defrag-max-backends"`
+
+	// new defragmentation is only started inside of these maintenance windows,
+	// backends which are not covered by any window (and all backends if there are no windows)
+	// are allowed to start defragmentation at any time
+	DefragWindows []DefragWindow		`json:"defrag-windows"`
+
+	// new defragmentation is postponed while proxy handles more than @DefragMaxRPS requests per second,
+	// zero means no limit
+	DefragMaxRPS float64			`json:"defrag-max-rps"`
+
+	// only proxy which owns defragmentation lease in metadata groups schedules defragmentation,
+	// lease is renewed on every scan (once per @DefragScanInterval seconds) and other proxies take it over
+	// after @DefragLeaseTTL seconds, it must be longer than scan interval
+	DefragLeaseTTL int			`json:"defrag-lease-ttl"`
+
+	// every proxy writes its registration record into metadata groups every @PeerHeartbeatInterval seconds
+	PeerHeartbeatInterval int		`json:"peer-heartbeat-interval"`
+
 	// all URL path strings which do not match registered handlers are being read
 	// as static objects living in @Root directory
 	// for example requesting http://example.com/crossdomain.xml URL
@@ -184,13 +341,47 @@ type ProxyClientConfig struct {
 	// HTTPS listen address
 	// when specified, there must be also specified CertFile and KeyFile parameters
 	// when set, server will listen on this address for incomming TLS connections
-	HTTPSAddress string			`json:"https_address"`
+	HTTPSAddress string			`json:"https_address" restart:"true"`
 
 	// certificate file for HTTPS server
-	CertFile string				`json:"cert_file"`
+	CertFile string				`json:"cert_file" restart:"true"`
 
 	// Key file for HTTPS server
-	KeyFile string				`json:"key_file"`
+	KeyFile string				`json:"key_file" restart:"true"`
+
+	// additional certificate and key pairs for HTTPS server, certificate is selected by SNI server name,
+	// @CertFile and @KeyFile pair is used when there is no matching certificate
+	Certificates []CertPair			`json:"certificates" restart:"true"`
+
+	// certificate and key files are checked every @CertReloadInterval seconds and reloaded if changed,
+	// all certificates are also reloaded on SIGHUP, zero means default interval,
+	// interval is set when HTTPS server starts, changed value requires restart
+	CertReloadInterval int			`json:"cert-reload-interval" restart:"true"`
+
+	// when set, HTTPS server verifies client certificates against CA bundle in this file,
+	// requests without 'Authorization' header are authenticated using verified client certificate
+	ClientCAFile string			`json:"client-ca-file" restart:"true"`
+
+	// reject TLS connections without client certificate
+	ClientCertRequired bool			`json:"client-cert-required" restart:"true"`
+
+	// client certificate field used as bucket ACL user name:
+	// 'cn' (subject common name, default), 'dns', 'email', 'uri' (subject alternative names) or 'subject'
+	ClientCertUser string			`json:"client-cert-user"`
+
+	// separate listen address for administrative handlers (stat, proxy_stat, profile, exit and so on),
+	// when set, administrative handlers are only served on this address
+	AdminAddress string			`json:"admin-address" restart:"true"`
+
+	// IP addresses and CIDR networks which are allowed to use administrative handlers without admin signature,
+	// when empty only loopback clients are allowed
+	AdminAllowlist []string			`json:"admin-allowlist"`
+
+	// admin user names and their tokens, request signed with admin token is allowed from any address
+	AdminUsers map[string]string		`json:"admin-users" secret:"true"`
+
+	// when set, @AdminUsers are read from this JSON file
+	AdminUsersFile string			`json:"admin-users-file"`
 
 	ContentTypes map[string]string		`json:"content-types"`
 
@@ -218,13 +409,18 @@ func (config *ProxyConfig) Save(file string) (err error) {
 	return
 }
 
+// LoadIO() parses config, unknown (for example misspelled) fields are treated as errors,
+// values from the environment and secret files override parsed values
 func (config *ProxyConfig) LoadIO(in io.Reader) (err error) {
-	data, err := ioutil.ReadAll(in)
+	dec := json.NewDecoder(in)
+	dec.DisallowUnknownFields()
+
+	err = dec.Decode(config)
 	if err != nil {
 		return
 	}
 
-	err = json.Unmarshal(data, config)
+	err = config.ApplyOverrides()
 	if err != nil {
 		return
 	}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ConfigChange describes one changed config field
+// fields tagged with `restart:"true"` are only used at start, their changes are not applied until restart
+// values of the fields tagged with `secret:"true"` are never shown
+type ConfigChange struct {
+	Field			string
+	Old			string
+	New			string
+	Restart			bool
+}
+
+func (ch *ConfigChange) String() string {
+	restart := ""
+	if ch.Restart {
+		restart = " (restart required)"
+	}
+
+	return fmt.Sprintf("%s: %s -> %s%s", ch.Field, ch.Old, ch.New, restart)
+}
+
+func field_name(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if len(name) == 0 {
+		name = f.Name
+	}
+
+	return name
+}
+
+func field_value(v reflect.Value, secret bool) string {
+	if secret {
+		if v.Len() == 0 {
+			return "<empty>"
+		}
+
+		return SecretPlaceholder
+	}
+
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Sprintf("%v", v.Interface())
+	}
+
+	return string(data)
+}
+
+func diff_struct(prefix string, old, new reflect.Value, changes []ConfigChange) []ConfigChange {
+	t := old.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if len(f.PkgPath) != 0 {
+			continue
+		}
+
+		name := prefix + field_name(f)
+		ov := old.Field(i)
+		nv := new.Field(i)
+
+		if f.Type.Kind() == reflect.Struct {
+			changes = diff_struct(name + ".", ov, nv, changes)
+			continue
+		}
+
+		if reflect.DeepEqual(ov.Interface(), nv.Interface()) {
+			continue
+		}
+
+		secret := f.Tag.Get("secret") == "true"
+		changes = append(changes, ConfigChange {
+			Field:		name,
+			Old:		field_value(ov, secret),
+			New:		field_value(nv, secret),
+			Restart:	f.Tag.Get("restart") == "true",
+		})
+	}
+
+	return changes
+}
+
+func keep_restart_struct(running, candidate reflect.Value) {
+	t := running.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if len(f.PkgPath) != 0 {
+			continue
+		}
+
+		if f.Tag.Get("restart") == "true" {
+			candidate.Field(i).Set(running.Field(i))
+			continue
+		}
+
+		if f.Type.Kind() == reflect.Struct {
+			keep_restart_struct(running.Field(i), candidate.Field(i))
+		}
+	}
+}
+
+// KeepRestartFields() copies values of the fields tagged with `restart:"true"` from @running config into @candidate,
+// so that config in use shows values which are actually in effect
+func KeepRestartFields(running, candidate *ProxyConfig) {
+	keep_restart_struct(reflect.ValueOf(running).Elem(), reflect.ValueOf(candidate).Elem())
+}
+
+// Diff() returns list of fields which differ in given configs
+func Diff(old, new *ProxyConfig) []ConfigChange {
+	return diff_struct("", reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem(), make([]ConfigChange, 0))
+}
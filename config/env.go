@@ -0,0 +1,194 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is a prefix of environment variables which override config values,
+// variable name is made of prefix, section and json field name, for example
+// 'proxy.redirect-token' is overridden by BACKRUNNER_PROXY_REDIRECT_TOKEN
+const EnvPrefix string = "BACKRUNNER"
+
+const SecretPlaceholder string = "<secret>"
+
+func env_name(prefix, field string) string {
+	return strings.ToUpper(strings.Replace(prefix + "_" + field, "-", "_", -1))
+}
+
+func set_env_value(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 0, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 0, 64)
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		// comma separated list of strings or numbers
+		parts := strings.Split(value, ",")
+		s := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, part := range parts {
+			err := set_env_value(s.Index(i), strings.TrimSpace(part))
+			if err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	default:
+		return fmt.Errorf("type %s can not be set from environment", v.Type().String())
+	}
+
+	return nil
+}
+
+func apply_env(prefix string, v reflect.Value) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if len(f.PkgPath) != 0 {
+			continue
+		}
+
+		name := env_name(prefix, field_name(f))
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		err := set_env_value(v.Field(i), value)
+		if err != nil {
+			return fmt.Errorf("environment variable %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func read_secret_file(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ApplyOverrides() replaces config values with values from the environment variables
+// and reads secrets from the files referenced in config
+func (config *ProxyConfig) ApplyOverrides() error {
+	err := apply_env(EnvPrefix + "_ELLIPTICS", reflect.ValueOf(&config.Elliptics).Elem())
+	if err != nil {
+		return err
+	}
+
+	err = apply_env(EnvPrefix + "_PROXY", reflect.ValueOf(&config.Proxy).Elem())
+	if err != nil {
+		return err
+	}
+
+	if len(config.Elliptics.TokenKeyFile) != 0 {
+		config.Elliptics.TokenKey, err = read_secret_file(config.Elliptics.TokenKeyFile)
+		if err != nil {
+			return fmt.Errorf("token-key-file: %v", err)
+		}
+	}
+
+	if len(config.Proxy.RedirectTokenDeprecated) != 0 {
+		log.Printf("config: proxy option 'RedirectToken' is deprecated, use 'redirect-token' instead\n")
+		if len(config.Proxy.RedirectToken) == 0 {
+			config.Proxy.RedirectToken = config.Proxy.RedirectTokenDeprecated
+		}
+		config.Proxy.RedirectTokenDeprecated = ""
+	}
+
+	if len(config.Proxy.RedirectTokenFile) != 0 {
+		config.Proxy.RedirectToken, err = read_secret_file(config.Proxy.RedirectTokenFile)
+		if err != nil {
+			return fmt.Errorf("redirect-token-file: %v", err)
+		}
+	}
+
+	if len(config.Proxy.AdminUsersFile) != 0 {
+		data, err := ioutil.ReadFile(config.Proxy.AdminUsersFile)
+		if err != nil {
+			return fmt.Errorf("admin-users-file: %v", err)
+		}
+
+		users := make(map[string]string)
+		err = json.Unmarshal(data, &users)
+		if err != nil {
+			return fmt.Errorf("admin-users-file: %s: %v", config.Proxy.AdminUsersFile, err)
+		}
+		config.Proxy.AdminUsers = users
+	}
+
+	return nil
+}
+
+func redact(v reflect.Value) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if len(f.PkgPath) != 0 {
+			continue
+		}
+
+		if f.Type.Kind() == reflect.Struct {
+			redact(v.Field(i))
+			continue
+		}
+
+		if f.Tag.Get("secret") != "true" || v.Field(i).Len() == 0 {
+			continue
+		}
+
+		switch f.Type.Kind() {
+		case reflect.String:
+			v.Field(i).SetString(SecretPlaceholder)
+		case reflect.Map:
+			// map is shared with the original config, keys are kept, values are replaced in a new map
+			m := reflect.MakeMap(f.Type)
+			for _, k := range v.Field(i).MapKeys() {
+				m.SetMapIndex(k, reflect.ValueOf(SecretPlaceholder))
+			}
+			v.Field(i).Set(m)
+		}
+	}
+}
+
+// Redacted() returns copy of the config where all secrets are replaced with placeholder,
+// this copy can be shown or logged
+func (config *ProxyConfig) Redacted() *ProxyConfig {
+	tmp := *config
+	redact(reflect.ValueOf(&tmp).Elem())
+	return &tmp
+}
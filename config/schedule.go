@@ -0,0 +1,145 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefragWindow is a maintenance window when defragmentation is allowed to start
+type DefragWindow struct {
+	// cron 'minute hour day-of-month month day-of-week' specification,
+	// every field is either '*' or comma separated list of numbers or ranges 'a-b', optionally followed by '/step',
+	// day-of-week is 0-7 (both 0 and 7 are sunday), like in cron, if both day-of-month and day-of-week
+	// are restricted (not '*'), time matches if either of them matches
+	// for example '* 1-6 * * 1-5' means from 01:00 till 06:59 from monday till friday
+	Schedule string				`json:"schedule"`
+
+	// groups and servers ('host:port:family' or just 'host') this window applies to,
+	// window applies to every backend if both lists are empty
+	Groups []uint32				`json:"groups,omitempty"`
+	Servers []string			`json:"servers,omitempty"`
+}
+
+type schedule_field struct {
+	name		string
+	min		int
+	max		int
+}
+
+var schedule_fields = []schedule_field {
+	schedule_field{"minute", 0, 59},
+	schedule_field{"hour", 0, 23},
+	schedule_field{"day-of-month", 1, 31},
+	schedule_field{"month", 1, 12},
+	schedule_field{"day-of-week", 0, 7},
+}
+
+func parse_schedule_field(spec string, f schedule_field) (map[int]bool, error) {
+	out := make(map[int]bool)
+
+	for _, part := range strings.Split(spec, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			s, err := strconv.Atoi(part[idx+1:])
+			if err != nil || s <= 0 {
+				return nil, fmt.Errorf("%s: invalid step in '%s'", f.name, part)
+			}
+
+			step = s
+			part = part[:idx]
+		}
+
+		start, end := f.min, f.max
+		if part != "*" {
+			var err error
+
+			bounds := strings.SplitN(part, "-", 2)
+			start, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid value '%s'", f.name, part)
+			}
+
+			end = start
+			if len(bounds) == 2 {
+				end, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, fmt.Errorf("%s: invalid range '%s'", f.name, part)
+				}
+			}
+		}
+
+		if start < f.min || end > f.max || start > end {
+			return nil, fmt.Errorf("%s: '%s' is out of [%d, %d] range", f.name, part, f.min, f.max)
+		}
+
+		for i := start; i <= end; i += step {
+			out[i] = true
+		}
+	}
+
+	// sunday is both 0 and 7
+	if f.name == "day-of-week" && out[7] {
+		out[0] = true
+	}
+
+	return out, nil
+}
+
+// Match() returns true if @t is inside of the maintenance window
+func (w *DefragWindow) Match(t time.Time) (bool, error) {
+	specs := strings.Fields(w.Schedule)
+	if len(specs) != len(schedule_fields) {
+		return false, fmt.Errorf("schedule '%s': there must be %d fields: minute hour day-of-month month day-of-week",
+			w.Schedule, len(schedule_fields))
+	}
+
+	values := []int {
+		t.Minute(),
+		t.Hour(),
+		t.Day(),
+		int(t.Month()),
+		int(t.Weekday()),
+	}
+
+	matched := make([]bool, len(specs))
+	for i, spec := range specs {
+		allowed, err := parse_schedule_field(spec, schedule_fields[i])
+		if err != nil {
+			return false, fmt.Errorf("schedule '%s': %v", w.Schedule, err)
+		}
+
+		matched[i] = allowed[values[i]]
+	}
+
+	// cron matches days if either day-of-month or day-of-week matches when both are restricted
+	const dom, dow = 2, 4
+	days := matched[dom] && matched[dow]
+	if !strings.HasPrefix(specs[dom], "*") && !strings.HasPrefix(specs[dow], "*") {
+		days = matched[dom] || matched[dow]
+	}
+
+	return matched[0] && matched[1] && matched[3] && days, nil
+}
+
+// Applies() returns true if window applies to given group and server address
+func (w *DefragWindow) Applies(group uint32, addr string) bool {
+	if len(w.Groups) == 0 && len(w.Servers) == 0 {
+		return true
+	}
+
+	for _, g := range w.Groups {
+		if g == group {
+			return true
+		}
+	}
+
+	for _, s := range w.Servers {
+		if addr == s || strings.HasPrefix(addr, s + ":") {
+			return true
+		}
+	}
+
+	return false
+}
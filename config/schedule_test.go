@@ -0,0 +1,116 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDefragWindowMatch(t *testing.T) {
+	// 2017-07-14 is friday, 2017-07-16 is sunday
+	friday := time.Date(2017, time.July, 14, 3, 30, 0, 0, time.UTC)
+	sunday := time.Date(2017, time.July, 16, 3, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		schedule	string
+		t		time.Time
+		match		bool
+	} {
+		{"* * * * *", friday, true},
+		{"* 1-6 * * 1-5", friday, true},
+		{"* 1-6 * * 1-5", sunday, false},
+		{"* 4-6 * * *", friday, false},
+		{"0-29 * * * *", friday, false},
+		{"*/15 * * * *", friday, true},
+		{"*/20 * * * *", friday, false},
+		{"30 3 14 7 *", friday, true},
+		{"* * * 8 *", friday, false},
+
+		// sunday is both 0 and 7
+		{"* * * * 0", sunday, true},
+		{"* * * * 7", sunday, true},
+		{"* * * * 6-7", sunday, true},
+
+		// restricted day-of-month and day-of-week match if either of them matches
+		{"* * 1 * 5", friday, true},
+		{"* * 14 * 1", friday, true},
+		{"* * 1 * 1", friday, false},
+
+		// only restricted field is checked when the other one is '*'
+		{"* * 1 * *", friday, false},
+		{"* * * * 1", friday, false},
+		{"* * */2 * 5", friday, false},
+	}
+
+	for _, test := range tests {
+		w := &DefragWindow {
+			Schedule:	test.schedule,
+		}
+
+		match, err := w.Match(test.t)
+		if err != nil {
+			t.Errorf("schedule '%s': unexpected error: %v", test.schedule, err)
+			continue
+		}
+		if match != test.match {
+			t.Errorf("schedule '%s', time: %s: match: %v, must be %v", test.schedule, test.t.String(), match, test.match)
+		}
+	}
+}
+
+func TestDefragWindowInvalid(t *testing.T) {
+	invalid := []string {
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+	}
+
+	for _, schedule := range invalid {
+		w := &DefragWindow {
+			Schedule:	schedule,
+		}
+
+		if _, err := w.Match(time.Now()); err == nil {
+			t.Errorf("schedule '%s' has been accepted", schedule)
+		}
+	}
+}
+
+func TestDefragWindowApplies(t *testing.T) {
+	all := &DefragWindow {}
+	if !all.Applies(1, "host:1025:2") {
+		t.Errorf("window without groups and servers must apply to every backend")
+	}
+
+	w := &DefragWindow {
+		Groups:		[]uint32{1, 2},
+		Servers:	[]string{"host1", "host2:1025:2"},
+	}
+
+	tests := []struct {
+		group		uint32
+		addr		string
+		applies		bool
+	} {
+		{1, "host3:1025:2", true},
+		{3, "host1:1025:2", true},
+		{3, "host2:1025:2", true},
+		{3, "host2:1026:2", false},
+		{3, "host10:1025:2", false},
+		{3, "host3:1025:2", false},
+	}
+
+	for _, test := range tests {
+		if applies := w.Applies(test.group, test.addr); applies != test.applies {
+			t.Errorf("group: %d, addr: %s: applies: %v, must be %v", test.group, test.addr, applies, test.applies)
+		}
+	}
+}
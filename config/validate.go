@@ -0,0 +1,240 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+type config_errors struct {
+	errors		[]string
+}
+
+func (ce *config_errors) add(field string, format string, args ...interface{}) {
+	ce.errors = append(ce.errors, fmt.Sprintf("%s: %s", field, fmt.Sprintf(format, args...)))
+}
+
+func (ce *config_errors) ratio(field string, v float64) {
+	if v < 0 || v > 1 {
+		ce.add(field, "%f must be in [0, 1] range", v)
+	}
+}
+
+func (ce *config_errors) non_negative(field string, v float64) {
+	if v < 0 {
+		ce.add(field, "%v must not be negative", v)
+	}
+}
+
+// ParseAllowlist() converts list of IP addresses and CIDR networks into networks,
+// single address is converted into network which contains only this address
+func ParseAllowlist(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+
+			nets = append(nets, n)
+			continue
+		}
+
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address '%s'", s)
+		}
+
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+
+		nets = append(nets, &net.IPNet {
+			IP:	ip,
+			Mask:	net.CIDRMask(bits, bits),
+		})
+	}
+
+	return nets, nil
+}
+
+func (config *EllipticsClientConfig) validate(ce *config_errors) {
+	if len(config.Remote) == 0 {
+		ce.add("elliptics.remote", "there must be at least one remote node")
+	}
+
+	if len(config.MetadataGroups) == 0 {
+		ce.add("elliptics.metadata-groups", "there must be at least one metadata group")
+	}
+}
+
+func (config *ProxyClientConfig) validate(ce *config_errors) {
+	if len(config.Address) == 0 && len(config.HTTPSAddress) == 0 {
+		ce.add("proxy.address", "either 'address' or 'https_address' must be specified")
+	}
+
+	if len(config.HTTPSAddress) != 0 {
+		if len(config.CertFile) == 0 {
+			ce.add("proxy.cert_file", "must be specified when 'https_address' is set")
+		}
+		if len(config.KeyFile) == 0 {
+			ce.add("proxy.key_file", "must be specified when 'https_address' is set")
+		}
+	}
+
+	for i, pair := range config.Certificates {
+		if len(pair.CertFile) == 0 || len(pair.KeyFile) == 0 {
+			ce.add(fmt.Sprintf("proxy.certificates[%d]", i), "both 'cert_file' and 'key_file' must be specified")
+		}
+	}
+	ce.non_negative("proxy.cert-reload-interval", float64(config.CertReloadInterval))
+
+	if len(config.ClientCAFile) != 0 && len(config.HTTPSAddress) == 0 {
+		ce.add("proxy.client-ca-file", "client certificates can only be verified when 'https_address' is set")
+	}
+	if config.ClientCertRequired && len(config.ClientCAFile) == 0 {
+		ce.add("proxy.client-cert-required", "'client-ca-file' must be specified")
+	}
+	switch config.ClientCertUser {
+	case "", "cn", "dns", "email", "uri", "subject":
+	default:
+		ce.add("proxy.client-cert-user", "unsupported value '%s', must be one of cn, dns, email, uri, subject",
+			config.ClientCertUser)
+	}
+
+	ce.non_negative("proxy.idle-timeout", float64(config.IdleTimeout))
+	ce.non_negative("proxy.drain-delay", float64(config.DrainDelay))
+	ce.non_negative("proxy.shutdown-timeout", float64(config.ShutdownTimeout))
+
+	ce.ratio("proxy.free-space-ratio-soft", config.FreeSpaceRatioSoft)
+	ce.ratio("proxy.free-space-ratio-hard", config.FreeSpaceRatioHard)
+	if config.FreeSpaceRatioSoft < config.FreeSpaceRatioHard {
+		ce.add("proxy.free-space-ratio-soft", "%f must not be less than 'free-space-ratio-hard' %f",
+			config.FreeSpaceRatioSoft, config.FreeSpaceRatioHard)
+	}
+
+	// zero intervals mean metadata and statistics are only read at start
+	ce.non_negative("proxy.bucket-update-interval", float64(config.BucketUpdateInterval))
+	ce.non_negative("proxy.bucket-stat-update-interval", float64(config.BucketStatUpdateInterval))
+	ce.non_negative("proxy.stat-max-age", float64(config.StatMaxAge))
+	// statistics is not updated after start when interval is zero,
+	// default max age of 3 update intervals would make it stale right after the first update
+	if config.BucketStatUpdateInterval == 0 && config.StatMaxAge == 0 {
+		ce.add("proxy.stat-max-age", "must be set when 'bucket-stat-update-interval' is zero")
+	}
+	ce.non_negative("proxy.ready-min-writable-buckets", float64(config.ReadyMinWritableBuckets))
+
+	ce.non_negative("proxy.timeouts.read", float64(config.Timeouts.Read))
+	ce.non_negative("proxy.timeouts.read-defrag", float64(config.Timeouts.ReadDefrag))
+	ce.non_negative("proxy.timeouts.write", float64(config.Timeouts.Write))
+	ce.non_negative("proxy.timeouts.lookup", float64(config.Timeouts.Lookup))
+	ce.non_negative("proxy.timeouts.delete", float64(config.Timeouts.Delete))
+	ce.non_negative("proxy.timeouts.stat", float64(config.Timeouts.Stat))
+	ce.non_negative("proxy.timeouts.metadata", float64(config.Timeouts.Metadata))
+
+	ce.non_negative("proxy.rate-limit.user.rps", config.RateLimit.User.RPS)
+	ce.non_negative("proxy.rate-limit.user.bps", config.RateLimit.User.BPS)
+	ce.non_negative("proxy.rate-limit.bucket.rps", config.RateLimit.Bucket.RPS)
+	ce.non_negative("proxy.rate-limit.bucket.bps", config.RateLimit.Bucket.BPS)
+	for user, l := range config.RateLimit.Users {
+		ce.non_negative(fmt.Sprintf("proxy.rate-limit.users.%s.rps", user), l.RPS)
+		ce.non_negative(fmt.Sprintf("proxy.rate-limit.users.%s.bps", user), l.BPS)
+	}
+	ce.non_negative("proxy.rate-limit.burst", config.RateLimit.Burst)
+
+	for name, l := range config.ConcurrencyLimits {
+		field := fmt.Sprintf("proxy.concurrency-limits.%s", name)
+		ce.non_negative(field + ".max-in-flight", float64(l.MaxInFlight))
+		ce.non_negative(field + ".max-queue", float64(l.MaxQueue))
+		ce.non_negative(field + ".queue-timeout", float64(l.QueueTimeout))
+	}
+
+	ce.non_negative("proxy.pid-state-save-interval", float64(config.PIDStateSaveInterval))
+	ce.non_negative("proxy.pid-state-max-age", float64(config.PIDStateMaxAge))
+
+	ce.ratio("proxy.read-error-rate-limit", config.ReadErrorRateLimit)
+	if config.ReadLatencyRatioLimit != 0 && config.ReadLatencyRatioLimit < 1 {
+		ce.add("proxy.read-latency-ratio-limit", "%f must be either zero or not less than 1", config.ReadLatencyRatioLimit)
+	}
+
+	// zero port means redirect is not allowed
+	if config.RedirectPort < 0 || config.RedirectPort >= 65536 {
+		ce.add("proxy.redirect-port", "%d must be in [0, 65536) range", config.RedirectPort)
+	}
+	ce.non_negative("proxy.redirect-signature-timeout", float64(config.RedirectSignatureTimeout))
+
+	ce.ratio("proxy.defrag-free-space-limit", config.DefragFreeSpaceLimit)
+	ce.ratio("proxy.defrag-removed-space-limit", config.DefragRemovedSpaceLimit)
+	if config.DefragMaxBuckets <= 0 {
+		ce.add("proxy.defrag-max-buckets", "%d must be positive", config.DefragMaxBuckets)
+	}
+	// zero per server limit disables defragmentation
+	ce.non_negative("proxy.defrag-max-backends-per-server", float64(config.DefragMaxBackendsPerServer))
+	// zero cluster limit and zero rate limit mean no limit
+	ce.non_negative("proxy.defrag-max-backends", float64(config.DefragMaxBackends))
+	ce.non_negative("proxy.defrag-max-rps", config.DefragMaxRPS)
+	ce.non_negative("proxy.defrag-lease-ttl", float64(config.DefragLeaseTTL))
+	if config.DefragLeaseTTL != 0 && config.DefragLeaseTTL <= DefragScanInterval {
+		ce.add("proxy.defrag-lease-ttl", "%d must be longer than defragmentation scan interval %d seconds",
+			config.DefragLeaseTTL, DefragScanInterval)
+	}
+
+	for i := range config.DefragWindows {
+		if _, err := config.DefragWindows[i].Match(time.Now()); err != nil {
+			ce.add(fmt.Sprintf("proxy.defrag-windows[%d]", i), "%v", err)
+		}
+	}
+
+	ce.non_negative("proxy.peer-heartbeat-interval", float64(config.PeerHeartbeatInterval))
+
+	ids := make(map[string]bool)
+	for i, key := range config.JWT.Keys {
+		field := fmt.Sprintf("proxy.jwt.keys[%d]", i)
+
+		if key.Alg != "HS256" && key.Alg != "RS256" && key.Alg != "ES256" {
+			ce.add(field, "unsupported algorithm '%s', must be one of HS256, RS256, ES256", key.Alg)
+		}
+		if len(key.File) == 0 {
+			ce.add(field, "key file must be specified")
+		}
+		if ids[key.ID + "/" + key.Alg] {
+			ce.add(field, "duplicate key id '%s' for algorithm %s", key.ID, key.Alg)
+		}
+		ids[key.ID + "/" + key.Alg] = true
+	}
+	ce.non_negative("proxy.jwt.leeway", float64(config.JWT.Leeway))
+	ce.non_negative("proxy.jwt.max-lifetime", float64(config.JWT.MaxLifetime))
+
+	if len(config.AdminAddress) != 0 &&
+			(config.AdminAddress == config.Address || config.AdminAddress == config.HTTPSAddress) {
+		ce.add("proxy.admin-address", "'%s' must differ from 'address' and 'https_address'", config.AdminAddress)
+	}
+	if _, err := ParseAllowlist(config.AdminAllowlist); err != nil {
+		ce.add("proxy.admin-allowlist", "%v", err)
+	}
+	for user, token := range config.AdminUsers {
+		if len(user) == 0 || len(token) == 0 {
+			ce.add("proxy.admin-users", "both user name and token must be specified")
+			break
+		}
+	}
+}
+
+// Validate() checks semantic correctness of the config, it returns error which lists all invalid fields
+func (config *ProxyConfig) Validate() error {
+	ce := &config_errors {}
+
+	config.Elliptics.validate(ce)
+	config.Proxy.validate(ce)
+
+	if len(ce.errors) != 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(ce.errors, "; "))
+	}
+
+	return nil
+}
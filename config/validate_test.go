@@ -0,0 +1,72 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func test_config() *ProxyConfig {
+	conf := &ProxyConfig {}
+
+	conf.Elliptics.Remote = []string{"localhost:1025:2"}
+	conf.Elliptics.MetadataGroups = []uint32{1}
+
+	conf.Proxy.Address = ":9090"
+	conf.Proxy.FreeSpaceRatioSoft = 0.2
+	conf.Proxy.FreeSpaceRatioHard = 0.1
+	conf.Proxy.BucketStatUpdateInterval = 5
+	conf.Proxy.DefragMaxBuckets = 1
+
+	return conf
+}
+
+// test_invalid() checks that config is rejected because of @field
+func test_invalid(t *testing.T, conf *ProxyConfig, field string) {
+	err := conf.Validate()
+	if err == nil {
+		t.Fatalf("config with invalid %s has been accepted", field)
+	}
+	if !strings.Contains(err.Error(), field + ":") {
+		t.Fatalf("config has been rejected not because of %s: %v", field, err)
+	}
+}
+
+func TestValidateDefault(t *testing.T) {
+	if err := test_config().Validate(); err != nil {
+		t.Fatalf("valid config has been rejected: %v", err)
+	}
+}
+
+func TestValidateStatMaxAge(t *testing.T) {
+	// statistics is only read at start, default max age would be zero
+	conf := test_config()
+	conf.Proxy.BucketStatUpdateInterval = 0
+	test_invalid(t, conf, "proxy.stat-max-age")
+
+	conf.Proxy.StatMaxAge = 3600
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("stat-max-age with zero update interval has been rejected: %v", err)
+	}
+
+	conf = test_config()
+	conf.Proxy.StatMaxAge = -1
+	test_invalid(t, conf, "proxy.stat-max-age")
+}
+
+func TestValidateDefragLimits(t *testing.T) {
+	conf := test_config()
+	conf.Proxy.DefragMaxBuckets = 0
+	test_invalid(t, conf, "proxy.defrag-max-buckets")
+
+	conf = test_config()
+	conf.Proxy.DefragMaxBackendsPerServer = -1
+	test_invalid(t, conf, "proxy.defrag-max-backends-per-server")
+
+	// zero means no limit
+	conf = test_config()
+	conf.Proxy.DefragMaxBackends = 0
+	conf.Proxy.DefragMaxRPS = 0
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("zero defragmentation cluster limits have been rejected: %v", err)
+	}
+}
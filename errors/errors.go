@@ -1,16 +1,24 @@
 package errors
 
 import (
+	"context"
 	"fmt"
 	"github.com/bioothod/elliptics-go/elliptics"
 	"net/http"
 	"syscall"
 )
 
+// non-standard status (introduced by nginx) of the request which has been closed by client
+// before response has been sent, it is also used for requests aborted by server shutdown
+const StatusClientClosedRequest int = 499
+
 type KeyError struct {
 	url	string
 	status	int
 	data	string
+
+	// number of seconds client should wait before retrying the request, zero if unknown
+	retry_after	int
 }
 
 func (k *KeyError) Error() string {
@@ -73,6 +81,46 @@ func NewKeyError(url string, status int, data string) (err *KeyError) {
 	return
 }
 
+// NewCanceledError() returns error of the operation aborted because request context is done,
+// operation which has exceeded its deadline returns http.StatusGatewayTimeout
+func NewCanceledError(url, op string, err error) *KeyError {
+	if err == context.DeadlineExceeded {
+		return NewKeyError(url, http.StatusGatewayTimeout, fmt.Sprintf("%s: request deadline has expired", op))
+	}
+
+	return NewKeyError(url, StatusClientClosedRequest, fmt.Sprintf("%s: request has been canceled: %v", op, err))
+}
+
+// NewThrottleError() returns http.StatusTooManyRequests error, @retry_after seconds is sent to client in Retry-After header
+func NewThrottleError(url string, data string, retry_after int) (err *KeyError) {
+	err = NewKeyError(url, http.StatusTooManyRequests, data)
+	err.retry_after = retry_after
+	return
+}
+
+// NewOverloadError() returns http.StatusServiceUnavailable error, @retry_after seconds is sent to client in Retry-After header
+func NewOverloadError(url string, data string, retry_after int) (err *KeyError) {
+	err = NewKeyError(url, http.StatusServiceUnavailable, data)
+	err.retry_after = retry_after
+	return
+}
+
+// ErrorRetryAfter() returns number of seconds client should wait before retrying the request, zero if unknown
+func ErrorRetryAfter(err error) int {
+	if ke, ok := err.(*KeyError); ok {
+		return ke.retry_after
+	}
+
+	return 0
+}
+
+// PrefixKeyError() returns copy of the error with @prefix added to its data, status and retry time are preserved
+func PrefixKeyError(err error, url, prefix string) (ret *KeyError) {
+	ret = NewKeyError(url, ErrorStatus(err), fmt.Sprintf("%s: %s", prefix, ErrorData(err)))
+	ret.retry_after = ErrorRetryAfter(err)
+	return
+}
+
 func NewKeyErrorFromEllipticsError(ellerr error, url, message string) (err *KeyError) {
 	err_code := elliptics.ErrorCode(ellerr)
 	err_message := elliptics.ErrorData(ellerr)
@@ -67,6 +67,8 @@ func (e *Estimator) PushNolock(requests, size uint64, status int) {
 		status = 200
 	case status >= 300 && status < 400:
 		status = 300
+	case status == 499:
+		// canceled requests are accounted separately from client errors
 	case status >= 400 && status < 500:
 		status = 400
 	case status >= 500 && status < 600:
@@ -123,3 +125,27 @@ func (e *Estimator) MarshalJSON() ([]byte, error) {
 
 	return json.Marshal(res)
 }
+
+// Rate() returns number of requests and bytes per second summed over all reply statuses,
+// it is averaged over the last @EstimatorRange seconds and does not update moving averages shown in stats
+func (e *Estimator) Rate() (rps float64, bps float64) {
+	second := time.Now().Second()
+
+	e.Lock()
+	defer e.Unlock()
+
+	for _, v := range e.RS {
+		for _, ss := range v.SStat {
+			if (second - ss.Second + 60) % 60 >= EstimatorRange {
+				continue
+			}
+
+			rps += float64(ss.RPS)
+			bps += float64(ss.BPS)
+		}
+	}
+
+	rps /= float64(EstimatorRange)
+	bps /= float64(EstimatorRange)
+	return
+}
@@ -0,0 +1,311 @@
+package estimator
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latency is accounted in histograms of @latency_slot_seconds seconds,
+// percentiles are calculated over the slots of the last 1, 5 and 15 minutes
+const LatencyWindowMinutes int = 15
+
+const latency_slot_seconds int64 = 10
+
+var LatencyWindows = []int{1, 5, 15}
+
+// histogram bucket upper bounds grow exponentially from 100 microseconds by @latency_bound_factor,
+// the last bucket contains everything above 2 minutes
+const (
+	latency_bound_min time.Duration		= 100 * time.Microsecond
+	latency_bound_max time.Duration		= 2 * time.Minute
+	latency_bound_factor float64		= 1.25
+)
+
+var latency_bounds []time.Duration = func() []time.Duration {
+	bounds := make([]time.Duration, 0)
+	for b := float64(latency_bound_min); ; b *= latency_bound_factor {
+		bounds = append(bounds, time.Duration(b))
+		if time.Duration(b) >= latency_bound_max {
+			break
+		}
+	}
+
+	return bounds
+}()
+
+func latency_bucket(d time.Duration) int {
+	// binary search of the first bound not less than @d
+	lo, hi := 0, len(latency_bounds)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if latency_bounds[mid] < d {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	return lo
+}
+
+type latency_slot struct {
+	// start time of the slot divided by @latency_slot_seconds
+	index		int64
+
+	// the last counter is overflow bucket
+	counts		[]uint64
+	total		uint64
+	sum		time.Duration
+	max		time.Duration
+}
+
+func (s *latency_slot) reset(index int64) {
+	s.index = index
+	for i := range s.counts {
+		s.counts[i] = 0
+	}
+	s.total = 0
+	s.sum = 0
+	s.max = 0
+}
+
+// Latency is a latency histogram of the last @LatencyWindowMinutes minutes
+type Latency struct {
+	sync.Mutex
+
+	slots		[]latency_slot
+}
+
+func NewLatency() *Latency {
+	l := &Latency {
+		slots:		make([]latency_slot, int64(LatencyWindowMinutes) * 60 / latency_slot_seconds),
+	}
+
+	for i := range l.slots {
+		l.slots[i].counts = make([]uint64, len(latency_bounds) + 1)
+		l.slots[i].index = -1
+	}
+
+	return l
+}
+
+func (l *Latency) Push(d time.Duration) {
+	index := time.Now().Unix() / latency_slot_seconds
+
+	l.Lock()
+	defer l.Unlock()
+
+	s := &l.slots[index % int64(len(l.slots))]
+	if s.index != index {
+		s.reset(index)
+	}
+
+	s.counts[latency_bucket(d)]++
+	s.total++
+	s.sum += d
+	if d > s.max {
+		s.max = d
+	}
+}
+
+type LatencyBucket struct {
+	// upper bound of the bucket in milliseconds, "+Inf" for the overflow bucket
+	LE		string		`json:"le"`
+	Count		uint64		`json:"count"`
+}
+
+// LatencyStat contains latencies in milliseconds
+type LatencyStat struct {
+	Count		uint64		`json:"count"`
+	Mean		float64		`json:"mean"`
+	Max		float64		`json:"max"`
+	P50		float64		`json:"p50"`
+	P90		float64		`json:"p90"`
+	P99		float64		`json:"p99"`
+
+	// non-empty histogram buckets
+	Histogram	[]LatencyBucket	`json:"histogram"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// percentile() interpolates latency of the request with rank @q * total within its histogram bucket
+func percentile(counts []uint64, total uint64, max time.Duration, q float64) float64 {
+	rank := q * float64(total)
+	var cum float64 = 0
+
+	for i, c := range counts {
+		if c == 0 {
+			continue
+		}
+
+		if cum + float64(c) >= rank {
+			lo := time.Duration(0)
+			if i > 0 {
+				lo = latency_bounds[i - 1]
+			}
+			hi := max
+			if i < len(latency_bounds) && latency_bounds[i] < max {
+				hi = latency_bounds[i]
+			}
+			if hi < lo {
+				hi = lo
+			}
+
+			return milliseconds(lo) + (milliseconds(hi) - milliseconds(lo)) * (rank - cum) / float64(c)
+		}
+
+		cum += float64(c)
+	}
+
+	return milliseconds(max)
+}
+
+// Stat() returns latency statistics of the last @minutes minutes, it is nil if there were no requests,
+// the current slot is not complete, so the window may be shorter by up to @latency_slot_seconds seconds
+func (l *Latency) Stat(minutes int) *LatencyStat {
+	now := time.Now().Unix() / latency_slot_seconds
+	first := now - int64(minutes) * 60 / latency_slot_seconds
+
+	counts := make([]uint64, len(latency_bounds) + 1)
+	var total uint64 = 0
+	var sum, max time.Duration
+
+	func() {
+		l.Lock()
+		defer l.Unlock()
+
+		for i := range l.slots {
+			s := &l.slots[i]
+			if s.index < 0 || s.index <= first || s.index > now {
+				continue
+			}
+
+			for j, c := range s.counts {
+				counts[j] += c
+			}
+			total += s.total
+			sum += s.sum
+			if s.max > max {
+				max = s.max
+			}
+		}
+	}()
+
+	if total == 0 {
+		return nil
+	}
+
+	st := &LatencyStat {
+		Count:		total,
+		Mean:		milliseconds(sum) / float64(total),
+		Max:		milliseconds(max),
+		P50:		percentile(counts, total, max, 0.5),
+		P90:		percentile(counts, total, max, 0.9),
+		P99:		percentile(counts, total, max, 0.99),
+		Histogram:	make([]LatencyBucket, 0),
+	}
+
+	for i, c := range counts {
+		if c == 0 {
+			continue
+		}
+
+		b := LatencyBucket {
+			LE:		"+Inf",
+			Count:		c,
+		}
+		if i < len(latency_bounds) {
+			b.LE = strconv.FormatFloat(milliseconds(latency_bounds[i]), 'f', -1, 64)
+		}
+
+		st.Histogram = append(st.Histogram, b)
+	}
+
+	return st
+}
+
+// Windows() returns statistics of every window in @LatencyWindows which has requests, i.e. "1m", "5m", "15m"
+func (l *Latency) Windows() map[string]*LatencyStat {
+	res := make(map[string]*LatencyStat)
+	for _, minutes := range LatencyWindows {
+		if st := l.Stat(minutes); st != nil {
+			res[fmt.Sprintf("%dm", minutes)] = st
+		}
+	}
+
+	return res
+}
+
+func (l *Latency) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Windows())
+}
+
+// request sizes are split into classes with these inclusive upper bounds, the last class contains larger requests
+var SizeClasses = []uint64{4 << 10, 64 << 10, 1 << 20, 16 << 20, 128 << 20}
+
+func size_class_name(i int) string {
+	if i == len(SizeClasses) {
+		return fmt.Sprintf("%s+", size_string(SizeClasses[i - 1]))
+	}
+
+	lo := "0"
+	if i > 0 {
+		lo = size_string(SizeClasses[i - 1])
+	}
+
+	return fmt.Sprintf("%s-%s", lo, size_string(SizeClasses[i]))
+}
+
+func size_string(size uint64) string {
+	switch {
+	case size >= 1 << 20 && size % (1 << 20) == 0:
+		return fmt.Sprintf("%dM", size >> 20)
+	case size >= 1 << 10 && size % (1 << 10) == 0:
+		return fmt.Sprintf("%dK", size >> 10)
+	}
+
+	return fmt.Sprintf("%d", size)
+}
+
+// SizeLatency keeps latency histogram for every request size class
+type SizeLatency struct {
+	classes		[]*Latency
+}
+
+func NewSizeLatency() *SizeLatency {
+	sl := &SizeLatency {
+		classes:	make([]*Latency, len(SizeClasses) + 1),
+	}
+
+	for i := range sl.classes {
+		sl.classes[i] = NewLatency()
+	}
+
+	return sl
+}
+
+func (sl *SizeLatency) Push(size uint64, d time.Duration) {
+	i := 0
+	for i < len(SizeClasses) && size > SizeClasses[i] {
+		i++
+	}
+
+	sl.classes[i].Push(d)
+}
+
+func (sl *SizeLatency) MarshalJSON() ([]byte, error) {
+	res := make(map[string]map[string]*LatencyStat)
+	for i, l := range sl.classes {
+		if w := l.Windows(); len(w) != 0 {
+			res[size_class_name(i)] = w
+		}
+	}
+
+	return json.Marshal(res)
+}
@@ -0,0 +1,166 @@
+package estimator
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLatencyBucket(t *testing.T) {
+	for i, b := range latency_bounds {
+		if idx := latency_bucket(b); idx != i {
+			t.Fatalf("bound %s: bucket %d, must be %d", b.String(), idx, i)
+		}
+		if idx := latency_bucket(b + 1); idx != i + 1 {
+			t.Fatalf("bound %s + 1ns: bucket %d, must be %d", b.String(), idx, i + 1)
+		}
+	}
+
+	if idx := latency_bucket(time.Hour); idx != len(latency_bounds) {
+		t.Fatalf("overflow: bucket %d, must be %d", idx, len(latency_bounds))
+	}
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	counts := make([]uint64, len(latency_bounds) + 1)
+
+	// 90 requests of 1ms and 10 requests of 100ms
+	fast := latency_bucket(time.Millisecond)
+	slow := latency_bucket(100 * time.Millisecond)
+	counts[fast] = 90
+	counts[slow] = 10
+	max := 100 * time.Millisecond
+
+	check := func(q float64, lo, hi time.Duration) {
+		p := percentile(counts, 100, max, q)
+		if p < milliseconds(lo) || p > milliseconds(hi) {
+			t.Errorf("p%.0f: %f ms, must be in [%f, %f] ms range", q * 100, p, milliseconds(lo), milliseconds(hi))
+		}
+	}
+
+	check(0.5, latency_bounds[fast - 1], latency_bounds[fast])
+	check(0.9, latency_bounds[fast - 1], latency_bounds[fast])
+	check(0.99, latency_bounds[slow - 1], max)
+
+	// percentile never exceeds the maximum latency even if bucket bound is larger
+	if p := percentile(counts, 100, max, 1); p != milliseconds(max) {
+		t.Errorf("p100: %f ms, must be %f ms", p, milliseconds(max))
+	}
+}
+
+func TestLatencyStat(t *testing.T) {
+	l := NewLatency()
+	if st := l.Stat(LatencyWindowMinutes); st != nil {
+		t.Fatalf("empty histogram must not have statistics: %+v", st)
+	}
+
+	for i := 0; i < 90; i++ {
+		l.Push(time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		l.Push(100 * time.Millisecond)
+	}
+	l.Push(time.Hour)
+
+	st := l.Stat(LatencyWindowMinutes)
+	if st == nil {
+		t.Fatalf("there are no statistics")
+	}
+
+	if st.Count != 100 || st.Max != milliseconds(time.Hour) {
+		t.Fatalf("count: %d, max: %f ms, must be 100 and %f ms", st.Count, st.Max, milliseconds(time.Hour))
+	}
+
+	mean := (90 * 1 + 9 * 100 + milliseconds(time.Hour)) / 100
+	if math.Abs(st.Mean - mean) > 1e-6 {
+		t.Fatalf("mean: %f ms, must be %f ms", st.Mean, mean)
+	}
+
+	// percentiles are interpolated within histogram buckets
+	in_bucket := func(name string, p float64, d time.Duration) {
+		i := latency_bucket(d)
+		if p < milliseconds(latency_bounds[i - 1]) || p > milliseconds(latency_bounds[i]) {
+			t.Errorf("%s: %f ms, must be in the bucket of %s: [%f, %f] ms", name, p, d.String(),
+				milliseconds(latency_bounds[i - 1]), milliseconds(latency_bounds[i]))
+		}
+	}
+
+	in_bucket("p50", st.P50, time.Millisecond)
+	in_bucket("p90", st.P90, time.Millisecond)
+	in_bucket("p99", st.P99, 100 * time.Millisecond)
+
+	if len(st.Histogram) != 3 {
+		t.Fatalf("histogram: %+v, must contain 3 buckets", st.Histogram)
+	}
+	if b := st.Histogram[2]; b.LE != "+Inf" || b.Count != 1 {
+		t.Fatalf("overflow bucket: %+v, must have '+Inf' bound and 1 request", b)
+	}
+	if b := st.Histogram[0]; b.LE == "+Inf" || b.Count != 90 {
+		t.Fatalf("first bucket: %+v, must have finite bound and 90 requests", b)
+	}
+}
+
+func TestLatencyWindows(t *testing.T) {
+	l := NewLatency()
+	now := time.Now().Unix() / latency_slot_seconds
+
+	// requests of the current slot and of the slots 2 and 6 minutes ago
+	for _, ago := range []int64{0, 120, 360} {
+		index := now - ago / latency_slot_seconds
+		s := &l.slots[index % int64(len(l.slots))]
+		s.reset(index)
+		s.counts[latency_bucket(time.Millisecond)]++
+		s.total++
+		s.sum += time.Millisecond
+		s.max = time.Millisecond
+	}
+
+	for _, test := range []struct {
+		minutes		int
+		count		uint64
+	} {
+		{1, 1},
+		{5, 2},
+		{15, 3},
+	} {
+		st := l.Stat(test.minutes)
+		if st == nil || st.Count != test.count {
+			t.Errorf("%d minutes window: %+v, must contain %d requests", test.minutes, st, test.count)
+		}
+	}
+}
+
+func TestSizeLatencyClasses(t *testing.T) {
+	tests := []struct {
+		size		uint64
+		class		string
+	} {
+		{0, "0-4K"},
+		{4 << 10, "0-4K"},
+		{4 << 10 + 1, "4K-64K"},
+		{1 << 20, "64K-1M"},
+		{128 << 20, "16M-128M"},
+		{128 << 20 + 1, "128M+"},
+	}
+
+	for _, test := range tests {
+		sl := NewSizeLatency()
+		sl.Push(test.size, time.Millisecond)
+
+		data, err := json.Marshal(sl)
+		if err != nil {
+			t.Fatalf("size %d: could not marshal: %v", test.size, err)
+		}
+
+		classes := make(map[string]interface{})
+		err = json.Unmarshal(data, &classes)
+		if err != nil {
+			t.Fatalf("size %d: could not unmarshal: %v", test.size, err)
+		}
+
+		if _, ok := classes[test.class]; !ok || len(classes) != 1 {
+			t.Errorf("size %d: classes: %s, must be only '%s'", test.size, string(data), test.class)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package etransport
 
 import (
 	"C"
+	"context"
 	"github.com/bioothod/elliptics-go/elliptics"
 	"github.com/DemonVex/backrunner/config"
 	"io"
@@ -13,6 +14,12 @@ import (
 	"sync"
 )
 
+// default timeouts in seconds of the data session (operations usually set their own) and statistics session
+const (
+	DefaultDataTimeout int		= 40
+	DefaultStatTimeout int		= 10
+)
+
 type Elliptics struct {
 	LogFile		io.WriteCloser
 
@@ -21,6 +28,20 @@ type Elliptics struct {
 
 	sync.Mutex
 	prev_stat	*elliptics.DnetStat
+
+	// zero values mean defaults
+	stat_timeout		int
+	metadata_timeout	int
+}
+
+// SetTimeouts() sets statistics and metadata sessions timeouts in seconds,
+// zero metadata timeout means elliptics node default
+func (e *Elliptics) SetTimeouts(stat, metadata int) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.stat_timeout = stat
+	e.metadata_timeout = metadata
 }
 
 func (e *Elliptics) MetadataSession() (ms *elliptics.Session, err error) {
@@ -29,17 +50,52 @@ func (e *Elliptics) MetadataSession() (ms *elliptics.Session, err error) {
 		return
 	}
 
+	e.Lock()
+	timeout := e.metadata_timeout
+	e.Unlock()
+
+	if timeout > 0 {
+		ms.SetTimeout(timeout)
+	}
+
 	ms.SetGroups(e.MetadataGroups)
 	return
 }
 
-func (e *Elliptics) DataSession(req *http.Request) (s *elliptics.Session, err error) {
+// context_reader fails reads when its context is done, it aborts elliptics write which reads client data
+type context_reader struct {
+	ctx		context.Context
+	r		io.Reader
+}
+
+func (cr *context_reader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cr.r.Read(p)
+}
+
+// ContextReader() returns reader which returns context error when @ctx is done
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &context_reader {
+		ctx:	ctx,
+		r:	r,
+	}
+}
+
+// DataSession() creates session for the request, it fails if request context @ctx is already done
+func (e *Elliptics) DataSession(ctx context.Context, req *http.Request) (s *elliptics.Session, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
 	s, err = elliptics.NewSession(e.Node)
 	if err != nil {
 		return
 	}
 
-	s.SetTimeout(40)
+	s.SetTimeout(DefaultDataTimeout)
 
 	values := req.URL.Query()
 	var val uint64
@@ -89,7 +145,15 @@ func (e *Elliptics) Stat() (stat *elliptics.DnetStat, err error) {
 	}
 	defer s.Delete()
 
-	s.SetTimeout(10)
+	e.Lock()
+	timeout := e.stat_timeout
+	e.Unlock()
+
+	if timeout <= 0 {
+		timeout = DefaultStatTimeout
+	}
+
+	s.SetTimeout(timeout)
 	stat = s.DnetStat()
 
 	e.Lock()
@@ -101,6 +165,22 @@ func (e *Elliptics) Stat() (stat *elliptics.DnetStat, err error) {
 	return
 }
 
+// Close() syncs and closes log file, log output is switched to stderr, it is called right before process exits,
+// elliptics node is not freed, since bucket control goroutines, drained operations and requests abandoned
+// after shutdown timeout may still use it, sessions of completed requests have already been deleted,
+// node itself is released by process exit
+func (e *Elliptics) Close() {
+	log.SetOutput(os.Stderr)
+	if e.LogFile != nil {
+		if f, ok := e.LogFile.(*os.File); ok {
+			f.Sync()
+		}
+
+		e.LogFile.Close()
+		e.LogFile = nil
+	}
+}
+
 func NewEllipticsTransport(conf *config.ProxyConfig) (e *Elliptics, err error) {
 	e = &Elliptics {
 		prev_stat: nil,
@@ -10,6 +10,7 @@ import (
 	"github.com/DemonVex/backrunner/etransport"
 	"io/ioutil"
 	"log"
+	"strings"
 )
 
 func bmeta_read_upload_file(ell *etransport.Elliptics, file, key string) (err error) {
@@ -95,6 +96,51 @@ func bmeta_read_upload(ell *etransport.Elliptics, file string) (err error) {
 	return
 }
 
+// bmeta_migrate_tokens() rewrites metadata of the buckets listed in @file with encrypted ACL tokens
+func bmeta_migrate_tokens(ell *etransport.Elliptics, file string) (err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatalf("Could not read bucket list file %s: %v", file, err)
+	}
+
+	failed := 0
+	for _, bname := range strings.Split(string(data), "\n") {
+		bname = strings.TrimSpace(bname)
+		if len(bname) == 0 {
+			continue
+		}
+
+		b, err := bucket.ReadBucket(ell, bname)
+		if err != nil {
+			log.Printf("Could not read bucket %s: %v", bname, err)
+			failed++
+			continue
+		}
+
+		if b.Meta.Version == bucket.BucketMetadataVersionEncrypted {
+			fmt.Printf("%s: ACL tokens are already encrypted\n", bname)
+			continue
+		}
+
+		b.Meta.Version = bucket.BucketMetadataVersionEncrypted
+
+		b, err = bucket.WriteBucket(ell, &b.Meta)
+		if err != nil {
+			log.Printf("Could not write bucket %s: %v", bname, err)
+			failed++
+			continue
+		}
+
+		log.Printf("migrated: %s\n", b.Meta.String())
+		fmt.Printf("migrated: %s\n", b.Meta.String())
+	}
+
+	if failed != 0 {
+		err = fmt.Errorf("could not migrate %d buckets", failed)
+	}
+	return
+}
+
 func main() {
 	bname := flag.String("bucket", "", "bucket name to read")
 	config_file := flag.String("config", "", "transport config file")
@@ -103,14 +149,18 @@ func main() {
 	bucket_list_upload := flag.String("upload-bucket-list", "",
 		"bucket list to upload into elliptics using 'bucket-list-key' config parameter")
 	upload := flag.String("upload", "", "bucket json file to upload/rewrite")
+	migrate_tokens := flag.String("migrate-tokens", "",
+		"file with new-line separated list of buckets whose metadata will be rewritten with encrypted ACL tokens " +
+		"using 'token-key' or 'token-key-file' config parameter")
 	flag.Parse()
 
-	if *bname == "" && *upload == "" && *backrunner_config == "" && *bucket_list_upload == "" {
+	if *bname == "" && *upload == "" && *backrunner_config == "" && *bucket_list_upload == "" && *migrate_tokens == "" {
 		log.Fatal("You must specify one (or more) of the following options:\n" +
 				"* bucket name to read\n" +
 				"* file with buckets metadata to upload\n" +
 				"* list of buckets to upload\n" +
-				"* backrunner config to upload\n")
+				"* backrunner config to upload\n" +
+				"* list of buckets to migrate to encrypted ACL tokens\n")
 	}
 
 	if *config_file == "" {
@@ -123,6 +173,15 @@ func main() {
 		log.Fatalf("Could not load config file '%s': %v", *config_file, err)
 	}
 
+	err = bucket.SetTokenKey(conf.Elliptics.TokenKey)
+	if err != nil {
+		log.Fatalf("Could not set token key: %v", err)
+	}
+
+	if *migrate_tokens != "" && len(conf.Elliptics.TokenKey) == 0 {
+		log.Fatalf("Requested ACL tokens migration, but there is no 'token-key' or 'token-key-file' option")
+	}
+
 	ell, err := etransport.NewEllipticsTransport(conf)
 	if err != nil {
 		log.Fatalf("Could not create Elliptics transport: %v", err)
@@ -147,6 +206,13 @@ func main() {
 		fmt.Printf("%s\n", b.Meta.String())
 	}
 
+	if *migrate_tokens != "" {
+		err = bmeta_migrate_tokens(ell, *migrate_tokens)
+		if err != nil {
+			log.Fatalf("migrate-tokens: %v", err)
+		}
+	}
+
 	if *backrunner_config != "" {
 		if len(conf.Elliptics.BackrunnerConfig) == 0 {
 			log.Fatalf("Requested uploading %s into elliptics as backrunner config, " +
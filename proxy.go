@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/DemonVex/backrunner/admission"
 	"github.com/DemonVex/backrunner/auth"
 	"github.com/DemonVex/backrunner/bucket"
+	"github.com/DemonVex/backrunner/certs"
 	"github.com/DemonVex/backrunner/config"
 	"github.com/DemonVex/backrunner/errors"
 	"github.com/DemonVex/backrunner/estimator"
@@ -15,19 +19,29 @@ import (
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const last_errors_length int = 128
 
+// seconds to wait for in-flight requests at shutdown if it is not configured
+const default_shutdown_timeout int = 30
+
+// time given to canceled in-flight requests to return when shutdown timeout has expired
+const shutdown_cancel_grace time.Duration = 5 * time.Second
+
 var (
 	proxy bproxy
 )
@@ -49,6 +63,19 @@ type bproxy struct {
 
 	error_index	uint64
 	last_errors	[]ErrorInfo
+
+	// administrative handlers are served on the separate listener
+	admin_listener	bool
+
+	servers		[]*http.Server
+	draining	int32
+
+	// base context of every request, it is canceled when in-flight requests do not complete in shutdown timeout
+	ctx		context.Context
+	cancel		context.CancelFunc
+
+	// number of requests canceled by client disconnect or shutdown
+	canceled	uint64
 }
 
 type Reply struct {
@@ -116,7 +143,7 @@ func (p *bproxy) send_upload_reply(w http.ResponseWriter, req *http.Request,
 func nobucket_upload_handler(w http.ResponseWriter, req *http.Request, strings ...string) Reply {
 	key := strings[0]
 
-	resp, bucket, err := proxy.bctl.Upload(key, req)
+	resp, bucket, err := proxy.bctl.Upload(req.Context(), key, req)
 	if err != nil {
 		return Reply {
 			err: err,
@@ -131,7 +158,7 @@ func bucket_upload_handler(w http.ResponseWriter, req *http.Request, strings ...
 	bucket := strings[0]
 	key := strings[1]
 
-	resp, b, err := proxy.bctl.BucketUpload(bucket, key, req)
+	resp, b, err := proxy.bctl.BucketUpload(req.Context(), bucket, key, req)
 	if err != nil {
 		return Reply {
 			err: err,
@@ -146,7 +173,7 @@ func get_handler(w http.ResponseWriter, req *http.Request, strings ...string) Re
 	bucket := strings[0]
 	key := strings[1]
 
-	err := proxy.bctl.Stream(bucket, key, w, req)
+	err := proxy.bctl.Stream(req.Context(), bucket, key, w, req)
 	if err != nil {
 		return Reply {
 			err: err,
@@ -161,7 +188,7 @@ func lookup_handler(w http.ResponseWriter, req *http.Request, strings ...string)
 	bucket := strings[0]
 	key := strings[1]
 
-	reply, err := proxy.bctl.Lookup(bucket, key, req)
+	reply, err := proxy.bctl.Lookup(req.Context(), bucket, key, req)
 	if err != nil {
 		return Reply {
 			err: err,
@@ -200,7 +227,7 @@ func redirect_handler(w http.ResponseWriter, req *http.Request, string_keys ...s
 	bname := string_keys[0]
 	key := string_keys[1]
 
-	reply, err := proxy.bctl.Lookup(bname, key, req)
+	reply, err := proxy.bctl.Lookup(req.Context(), bname, key, req)
 	if err != nil {
 		return Reply {
 			err: err,
@@ -316,7 +343,7 @@ func delete_handler(w http.ResponseWriter, req *http.Request, strings ...string)
 	bucket := strings[0]
 	key := strings[1]
 
-	err := proxy.bctl.Delete(bucket, key, req)
+	err := proxy.bctl.Delete(req.Context(), bucket, key, req)
 	if err != nil {
 		return Reply {
 			err: err,
@@ -368,7 +395,7 @@ func bulk_delete_handler(w http.ResponseWriter, req *http.Request, strings ...st
 		}
 	}
 
-	reply, err := proxy.bctl.BulkDelete(bucket, keys, req)
+	reply, err := proxy.bctl.BulkDelete(req.Context(), bucket, keys, req)
 	if err != nil {
 		return Reply {
 			err: err,
@@ -441,13 +468,70 @@ func profile_handler(w http.ResponseWriter, req *http.Request, strings ...string
 	return GoodReply()
 }
 
+// exit_handler() starts graceful shutdown, in-flight requests including this one are allowed to complete
 func exit_handler(w http.ResponseWriter, req *http.Request, strings ...string) Reply {
-	proxy.bctl.DumpProfileFile(true)
 	proxy.bctl.DumpProfile(w)
-	os.Exit(-1)
+	go proxy.shutdown(fmt.Sprintf("exit request from %s", req.RemoteAddr))
 	return GoodReply()
 }
 
+// ping_handler() is a cheap check which only fails when proxy is draining
+func ping_handler(w http.ResponseWriter, req *http.Request, str ...string) Reply {
+	if atomic.LoadInt32(&proxy.draining) != 0 {
+		return Reply {
+			err: errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable, "proxy is draining"),
+			status: http.StatusServiceUnavailable,
+		}
+	}
+
+	return healthz_handler(w, req, str...)
+}
+
+// healthz_handler() is a liveness check, it succeeds while process is able to serve requests
+func healthz_handler(w http.ResponseWriter, req *http.Request, str ...string) Reply {
+	data := []byte("OK")
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+
+	return GoodReplyLength(uint64(len(data)))
+}
+
+// readyz_handler() is a readiness check, reply contains results of all checks,
+// status is http.StatusServiceUnavailable if any critical check has failed
+func readyz_handler(w http.ResponseWriter, req *http.Request, str ...string) Reply {
+	r := proxy.bctl.Ready()
+
+	var err error
+	if atomic.LoadInt32(&proxy.draining) != 0 {
+		err = fmt.Errorf("proxy is draining")
+	}
+	r.Add("draining", true, err, "")
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
+			fmt.Sprintf("readyz: json marshal failed: %q", err))
+		return Reply {
+			err: err,
+			status: http.StatusServiceUnavailable,
+		}
+	}
+
+	status := http.StatusOK
+	if !r.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.WriteHeader(status)
+	w.Write(data)
+
+	return Reply {
+		status: status,
+		length: uint64(len(data)),
+	}
+}
+
 func stat_handler(w http.ResponseWriter, req *http.Request, str ...string) Reply {
 	bnames := make([]string, 0)
 
@@ -484,6 +568,128 @@ func stat_handler(w http.ResponseWriter, req *http.Request, str ...string) Reply
 }
 
 
+func select_explain_handler(w http.ResponseWriter, req *http.Request, strings ...string) Reply {
+	q := req.URL.Query()
+
+	key := q.Get("key")
+	if len(key) == 0 {
+		err := errors.NewKeyError(req.URL.String(), http.StatusBadRequest,
+			"select-explain: there is no 'key' parameter")
+		return Reply {
+			err: err,
+			status: errors.ErrorStatus(err),
+		}
+	}
+
+	var size uint64 = 0
+	if size_str := q.Get("size"); len(size_str) != 0 {
+		var err error
+		size, err = strconv.ParseUint(size_str, 0, 64)
+		if err != nil {
+			err = errors.NewKeyError(req.URL.String(), http.StatusBadRequest,
+				fmt.Sprintf("select-explain: invalid size '%s': %v", size_str, err))
+			return Reply {
+				err: err,
+				status: errors.ErrorStatus(err),
+			}
+		}
+	}
+
+	reply, err := proxy.bctl.SelectExplain(key, size, req)
+	if err != nil {
+		return Reply {
+			err: err,
+			status: errors.ErrorStatus(err),
+		}
+	}
+
+	reply_json, err := json.Marshal(reply)
+	if err != nil {
+		err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
+			fmt.Sprintf("select-explain: json marshal failed: %q", err))
+		return Reply {
+			err: err,
+			status: http.StatusServiceUnavailable,
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(reply_json)
+
+	return GoodReply()
+}
+
+func defrag_handler(w http.ResponseWriter, req *http.Request, strings ...string) Reply {
+	action := strings[0]
+
+	reply, err := proxy.bctl.DefragControl(action, req)
+	if err != nil {
+		return Reply {
+			err: err,
+			status: errors.ErrorStatus(err),
+		}
+	}
+
+	reply_json, err := json.Marshal(reply)
+	if err != nil {
+		err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
+			fmt.Sprintf("defrag: json marshal failed: %q", err))
+		return Reply {
+			err: err,
+			status: http.StatusServiceUnavailable,
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(reply_json)
+
+	return GoodReply()
+}
+
+func peers_handler(w http.ResponseWriter, req *http.Request, strings ...string) Reply {
+	reply, err := proxy.bctl.Peers()
+	if err != nil {
+		err = errors.NewKeyErrorFromEllipticsError(err, req.URL.String(), "peers: could not read peers index")
+		return Reply {
+			err: err,
+			status: errors.ErrorStatus(err),
+		}
+	}
+
+	reply_json, err := json.Marshal(reply)
+	if err != nil {
+		err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
+			fmt.Sprintf("peers: json marshal failed: %q", err))
+		return Reply {
+			err: err,
+			status: http.StatusServiceUnavailable,
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(reply_json)
+
+	return GoodReply()
+}
+
+// request_rate() returns number of requests per second handled by all handlers
+func request_rate() float64 {
+	var rps float64 = 0
+	for _, h := range estimator_scan_handlers {
+		r, _ := h.Estimator.Rate()
+		rps += r
+	}
+
+	return rps
+}
+
+// handlers which account latency split by the size of uploaded or read data
+var size_latency_handlers = map[string]bool {
+	"nobucket_upload":	true,
+	"upload":		true,
+	"get":			true,
+}
+
 // this uglymoron is needed to prevent Golang initialization loop logic from exploding
 var estimator_scan_handlers map[string]*handler
 
@@ -491,6 +697,12 @@ type proxy_stat_reply struct {
 	BucketCtlStat	*bucket.BucketCtlStat
 	Handlers	map[string]*handler	`json:"handlers"`
 	Errors		[]ErrorInfo		`json:"errors"`
+
+	// number of requests rejected because of per user and per bucket rate limits
+	Throttled	*bucket.ThrottleStat	`json:"throttled"`
+
+	// number of requests canceled by client disconnect or shutdown, they are not accounted as errors
+	Canceled	uint64			`json:"canceled"`
 }
 
 func proxy_stat_handler(w http.ResponseWriter, req *http.Request, strings ...string) Reply {
@@ -504,6 +716,8 @@ func proxy_stat_handler(w http.ResponseWriter, req *http.Request, strings ...str
 		BucketCtlStat:	proxy.bctl.NewBucketCtlStat(),
 		Handlers:	estimator_scan_handlers,
 		Errors:		make([]ErrorInfo, l),
+		Throttled:	bucket.NewThrottleStat(),
+		Canceled:	atomic.LoadUint64(&proxy.canceled),
 	}
 
 	if start_idx <= uint64(len(proxy.last_errors)) {
@@ -542,7 +756,43 @@ type handler struct {
 	// handler Function
 	Function		func(w http.ResponseWriter, req *http.Request, v...string) Reply		`json:"-"`
 
+	// administrative handlers are only allowed for admin realm (see auth.AdminRealm),
+	// when admin address is configured, they are only served there
+	Admin			bool				`json:"-"`
+
 	Estimator		*estimator.Estimator		`json:"RS"`
+
+	// request processing time of the last minutes, canceled requests are not accounted
+	Latency			*estimator.Latency		`json:"latency"`
+
+	// latency of successful requests split by request size, only set for upload and get handlers
+	SizeLatency		*estimator.SizeLatency		`json:"size-latency,omitempty"`
+
+	// limits number of concurrently processed requests, see config 'concurrency-limits'
+	Admission		*admission.Controller		`json:"admission"`
+
+	// key in @proxy_handlers
+	name			string
+}
+
+// admit() waits for processing slot of the handler, limits are taken from the current config
+func (h *handler) admit(req *http.Request) error {
+	proxy.bctl.RLock()
+	limit := proxy.bctl.Conf.Proxy.ConcurrencyLimits[h.name]
+	proxy.bctl.RUnlock()
+
+	h.Admission.Configure(limit.MaxInFlight, limit.MaxQueue, time.Duration(limit.QueueTimeout) * time.Millisecond)
+
+	err := h.Admission.Acquire(req.Context())
+	if err != nil {
+		if err == req.Context().Err() {
+			return errors.NewCanceledError(req.URL.String(), h.name, err)
+		}
+
+		return errors.NewOverloadError(req.URL.String(), fmt.Sprintf("%s: %v", h.name, err), h.Admission.RetryAfter())
+	}
+
+	return nil
 }
 
 var proxy_handlers = map[string]*handler {
@@ -584,17 +834,47 @@ var proxy_handlers = map[string]*handler {
 	"ping": &handler{
 		Params: 0,
 		Methods: []string{"GET"},
-		Function: stat_handler,
+		Function: ping_handler,
+	},
+	"healthz": &handler{
+		Params: 0,
+		Methods: []string{"GET"},
+		Function: healthz_handler,
+	},
+	"readyz": &handler{
+		Params: 0,
+		Methods: []string{"GET"},
+		Function: readyz_handler,
 	},
 	"stat": &handler{
 		Params: 0,
 		Methods: []string{"GET"},
 		Function: stat_handler,
+		Admin: true,
+	},
+	"select_explain": &handler{
+		Params: 0,
+		Methods: []string{"GET"},
+		Function: select_explain_handler,
+		Admin: true,
+	},
+	"defrag": &handler{
+		Params: 1,
+		Methods: []string{"GET", "POST", "PUT"},
+		Function: defrag_handler,
+		Admin: true,
+	},
+	"peers": &handler{
+		Params: 0,
+		Methods: []string{"GET"},
+		Function: peers_handler,
+		Admin: true,
 	},
 	"proxy_stat": &handler{
 		Params: 0,
 		Methods: []string{"GET"},
 		Function: proxy_stat_handler,
+		Admin: true,
 	},
 	"/": &handler{
 		Params: 0,
@@ -605,11 +885,13 @@ var proxy_handlers = map[string]*handler {
 		Params:	0,
 		Methods: []string{"GET"},
 		Function: exit_handler,
+		Admin: true,
 	},
 	"profile": &handler{
 		Params:	0,
 		Methods: []string{"GET"},
 		Function: profile_handler,
+		Admin: true,
 	},
 }
 
@@ -628,7 +910,29 @@ func get_content_length(header http.Header) uint64 {
 	return content_length
 }
 
+func check_admin(req *http.Request) error {
+	proxy.bctl.RLock()
+	realm := proxy.bctl.AdminRealm
+	proxy.bctl.RUnlock()
+
+	err := realm.Check(req)
+	if err != nil {
+		return errors.NewKeyError(req.URL.String(), http.StatusForbidden, err.Error())
+	}
+
+	return nil
+}
+
 func generic_handler(w http.ResponseWriter, req *http.Request) {
+	serve_request(w, req, false)
+}
+
+// admin_handler() serves requests on the admin listener, only administrative handlers are registered there
+func admin_handler(w http.ResponseWriter, req *http.Request) {
+	serve_request(w, req, true)
+}
+
+func serve_request(w http.ResponseWriter, req *http.Request, admin_listener bool) {
 	// join together sequential // in the URL path
 
 	start := time.Now()
@@ -649,6 +953,7 @@ func generic_handler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var h *handler = nil
+	handled := false
 
 	if req.Method == "HEAD" {
 		w.WriteHeader(http.StatusOK)
@@ -670,11 +975,19 @@ func generic_handler(w http.ResponseWriter, req *http.Request) {
 
 			param_strings := make([]string, 0)
 			h, ok = proxy_handlers[hstrings[1]]
-			if !ok {
+			if (admin_listener && (!ok || !h.Admin)) || (!admin_listener && ok && h.Admin && proxy.admin_listener) {
+				h = nil
+				ok = false
+			} else if !ok {
 				h = proxy_handlers["/"]
 				param_strings = []string{path}
 				ok = true
 			} else {
+				// handlers without parameters are also reachable without trailing slash, i.e. /healthz
+				if len(hstrings) == 2 && h.Params == 0 {
+					hstrings = append(hstrings, "")
+				}
+
 				if len(hstrings) != 3 {
 					reply.err = errors.NewKeyError(req.URL.String(), http.StatusBadRequest,
 						fmt.Sprintf("not enough path parts for handler: %v, must be at least: %d",
@@ -710,7 +1023,26 @@ func generic_handler(w http.ResponseWriter, req *http.Request) {
 				}
 
 				if method_matched {
-					reply = h.Function(w, req, param_strings...)
+					var err error
+					if h.Admin {
+						err = check_admin(req)
+					}
+					if err == nil {
+						err = h.admit(req)
+					}
+
+					if err != nil {
+						reply = Reply {
+							err: err,
+							status: errors.ErrorStatus(err),
+						}
+					} else {
+						func() {
+							defer h.Admission.Release()
+							reply = h.Function(w, req, param_strings...)
+						}()
+						handled = true
+					}
 				} else {
 					reply.err = errors.NewKeyError(req.URL.String(), http.StatusBadRequest,
 						fmt.Sprintf("method doesn't match: provided: %s, required: %v",
@@ -721,9 +1053,27 @@ func generic_handler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	msg := "OK"
+	canceled := false
 	if reply.err != nil {
 		msg = reply.err.Error()
-		proxy.add_error(req.Method, req.RemoteAddr, req.URL.RequestURI(), reply.status, msg)
+
+		if reply.status == errors.StatusClientClosedRequest || req.Context().Err() != nil {
+			atomic.AddUint64(&proxy.canceled, 1)
+
+			if proxy.ctx.Err() != nil {
+				// proxy is shutting down, client is still connected and must not get implicit 200 OK
+				reply.status = http.StatusServiceUnavailable
+				reply.err = errors.NewKeyError(req.URL.String(), http.StatusServiceUnavailable,
+					fmt.Sprintf("request has been aborted by proxy shutdown: %s", msg))
+				msg = reply.err.Error()
+			} else {
+				// client has gone, there is nobody to send error to
+				reply.status = errors.StatusClientClosedRequest
+				canceled = true
+			}
+		} else {
+			proxy.add_error(req.Method, req.RemoteAddr, req.URL.RequestURI(), reply.status, msg)
+		}
 	}
 
 	if content_length == 0 {
@@ -736,6 +1086,14 @@ func generic_handler(w http.ResponseWriter, req *http.Request) {
 	duration := time.Since(start)
 	if h != nil {
 		h.Estimator.Push(content_length, reply.status)
+
+		// requests rejected before the handler, i.e. by admission or admin checks, would skew latency
+		if handled && !canceled {
+			h.Latency.Push(duration)
+		}
+		if handled && h.SizeLatency != nil && reply.status >= 200 && reply.status < 300 {
+			h.SizeLatency.Push(content_length, duration)
+		}
 	}
 
 	log.Printf("access_log: method: '%s', client: '%s', x-fwd: '%v', path: '%s', encoded-uri: '%s', status: %d, size: %d, time: %.3f ms, err: '%v'\n",
@@ -743,7 +1101,11 @@ func generic_handler(w http.ResponseWriter, req *http.Request) {
 		path, req.URL.RequestURI(), reply.status, content_length,
 		float64(duration.Nanoseconds()) / 1000000.0, msg)
 
-	if reply.err != nil {
+	if reply.err != nil && !canceled {
+		if retry_after := errors.ErrorRetryAfter(reply.err); retry_after > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retry_after))
+		}
+
 		http.Error(w, reply.err.Error(), reply.status)
 	}
 }
@@ -753,6 +1115,9 @@ func (proxy *bproxy) getTimeoutServer(addr string, handler http.Handler) *http.S
 	return &http.Server{
 		Addr:         addr,
 		Handler:      handler,
+		BaseContext:  func(net.Listener) context.Context {
+			return proxy.ctx
+		},
 		// disable timeout checks, looks like these are not fair timeouts,
 		// but instead maximum duration of the handler
 		//ReadTimeout:  time.Duration(proxy.bctl.Conf.Proxy.IdleTimeout) * time.Second,
@@ -760,6 +1125,92 @@ func (proxy *bproxy) getTimeoutServer(addr string, handler http.Handler) *http.S
 	}
 }
 
+// serve() runs server until it is shut down
+// serve() runs server until it is shut down, server with TLS config listens for HTTPS connections
+func (proxy *bproxy) serve(server *http.Server) {
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// shutdown() drains proxy: ping fails for @DrainDelay seconds, then listeners are closed
+// and in-flight requests are waited for up to @ShutdownTimeout seconds,
+// after that state is saved, log is flushed and process exits,
+// elliptics node is not freed, since abandoned requests and bucket control goroutines may still use it (see etransport.Elliptics.Close())
+func (proxy *bproxy) shutdown(reason string) {
+	if !atomic.CompareAndSwapInt32(&proxy.draining, 0, 1) {
+		return
+	}
+
+	proxy.bctl.RLock()
+	drain_delay := proxy.bctl.Conf.Proxy.DrainDelay
+	timeout := proxy.bctl.Conf.Proxy.ShutdownTimeout
+	proxy.bctl.RUnlock()
+
+	if timeout == 0 {
+		timeout = default_shutdown_timeout
+	}
+
+	log.Printf("shutdown: %s, drain delay: %d seconds, in-flight requests timeout: %d seconds\n",
+		reason, drain_delay, timeout)
+
+	for _, server := range proxy.servers {
+		server.SetKeepAlivesEnabled(false)
+	}
+	time.Sleep(time.Duration(drain_delay) * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout) * time.Second)
+	defer cancel()
+
+	var failed int32
+	var wg sync.WaitGroup
+	for _, server := range proxy.servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+
+			err := server.Shutdown(ctx)
+			if err != nil {
+				log.Printf("shutdown: server: %s: could not complete in-flight requests: %v\n", server.Addr, err)
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	if failed != 0 {
+		// abort elliptics operations of requests which have not completed in time and give them a moment to return
+		log.Printf("shutdown: canceling in-flight requests\n")
+		proxy.cancel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdown_cancel_grace)
+		for _, server := range proxy.servers {
+			server.Shutdown(ctx)
+		}
+		cancel()
+	}
+
+	proxy.bctl.SavePIDState()
+	proxy.bctl.SaveDefragHistory()
+	proxy.bctl.DumpProfileFile(true)
+
+	code := 0
+	if failed != 0 {
+		code = 1
+	}
+
+	log.Printf("shutdown: completed, exit code: %d\n", code)
+	proxy.ell.Close()
+	os.Exit(code)
+}
+
 type stringslice []string
 
 func (str *stringslice) String() string {
@@ -776,14 +1227,21 @@ func main() {
 
 	buckets := flag.String("buckets", "", "buckets file (file format: new-line separated list of bucket names)")
 	config_file := flag.String("config", "", "Transport config file")
+	check_config := flag.Bool("check-config", false, "Check config file and exit")
 	flag.Parse()
 
 	if *config_file == "" {
 		log.Fatal("You must specify config file")
 	}
 
-	for _, h := range proxy_handlers {
+	for name, h := range proxy_handlers {
 		h.Estimator = estimator.NewEstimator()
+		h.Latency = estimator.NewLatency()
+		if size_latency_handlers[name] {
+			h.SizeLatency = estimator.NewSizeLatency()
+		}
+		h.Admission = admission.NewController()
+		h.name = name
 	}
 	estimator_scan_handlers = proxy_handlers
 
@@ -795,6 +1253,39 @@ func main() {
 		log.Fatalf("Could not load config %s: %q", *config_file, err)
 	}
 
+	err = conf.Validate()
+	if err != nil {
+		log.Fatalf("Config %s: %v", *config_file, err)
+	}
+
+	for name := range conf.Proxy.ConcurrencyLimits {
+		if _, ok := proxy_handlers[name]; !ok {
+			log.Fatalf("Config %s: concurrency-limits: there is no handler '%s'", *config_file, name)
+		}
+	}
+
+	_, err = auth.NewJWTVerifier(&conf.Proxy.JWT)
+	if err != nil {
+		log.Fatalf("Config %s: %v", *config_file, err)
+	}
+
+	_, err = auth.NewAdminRealm(&conf.Proxy)
+	if err != nil {
+		log.Fatalf("Config %s: %v", *config_file, err)
+	}
+
+	if len(conf.Proxy.ClientCAFile) != 0 {
+		_, err = auth.LoadCertPool(conf.Proxy.ClientCAFile)
+		if err != nil {
+			log.Fatalf("Config %s: client-ca-file: %v", *config_file, err)
+		}
+	}
+
+	if *check_config {
+		fmt.Printf("Config %s is valid\n", *config_file)
+		return
+	}
+
 	if *buckets == "" && len(conf.Elliptics.BucketList) == 0 {
 		log.Fatalf("There is no buckets file and there is no 'bucket-list' option in elliptics config.")
 	}
@@ -810,6 +1301,7 @@ func main() {
 	}
 
 	proxy.last_errors = make([]ErrorInfo, last_errors_length, last_errors_length)
+	proxy.ctx, proxy.cancel = context.WithCancel(context.Background())
 
 	proxy.ell, err = etransport.NewEllipticsTransport(conf)
 	if err != nil {
@@ -818,11 +1310,18 @@ func main() {
 
 	rand.Seed(time.Now().Unix())
 
-	proxy.bctl, err = bucket.NewBucketCtl(proxy.ell, *buckets, *config_file)
+	proxy.bctl, err = bucket.NewBucketCtl(proxy.ell, *buckets, *config_file, request_rate)
 	if err != nil {
 		log.Fatalf("Could not create new bucket controller: %v", err)
 	}
 
+	if len(conf.Proxy.AdminAddress) != 0 {
+		proxy.admin_listener = true
+
+		server := proxy.getTimeoutServer(conf.Proxy.AdminAddress, http.HandlerFunc(admin_handler))
+		proxy.servers = append(proxy.servers, server)
+	}
+
 	if len(conf.Proxy.HTTPSAddress) != 0 {
 		if len(conf.Proxy.CertFile) == 0 {
 			log.Fatalf("If you have specified HTTPS address there MUST be certificate file option")
@@ -832,15 +1331,71 @@ func main() {
 			log.Fatalf("If you have specified HTTPS address there MUST be key file option")
 		}
 
-		// this is needed to allow both HTTPS and HTTP handlers
+		server := proxy.getTimeoutServer(proxy.bctl.Conf.Proxy.HTTPSAddress, http.HandlerFunc(generic_handler))
+		server.TLSConfig = &tls.Config {}
+		if len(conf.Proxy.ClientCAFile) != 0 {
+			server.TLSConfig, err = auth.ClientTLSConfig(conf.Proxy.ClientCAFile, conf.Proxy.ClientCertRequired)
+			if err != nil {
+				log.Fatalf("Could not load client CA file '%s': %v", conf.Proxy.ClientCAFile, err)
+			}
+		}
+
+		pairs := []certs.Pair {
+			certs.Pair {
+				CertFile:	conf.Proxy.CertFile,
+				KeyFile:	conf.Proxy.KeyFile,
+			},
+		}
+		for _, p := range conf.Proxy.Certificates {
+			pairs = append(pairs, certs.Pair {
+				CertFile:	p.CertFile,
+				KeyFile:	p.KeyFile,
+			})
+		}
+
+		cert_store, err := certs.NewStore(pairs)
+		if err != nil {
+			log.Fatalf("Could not load HTTPS certificates: %v", err)
+		}
+		server.TLSConfig.GetCertificate = cert_store.GetCertificate
+
+		reload_interval := conf.Proxy.CertReloadInterval
+		if reload_interval <= 0 {
+			reload_interval = certs.DefaultReloadInterval
+		}
+		cert_store.Watch(time.Duration(reload_interval) * time.Second)
+
+		// new connections use reloaded certificates, established connections are not affected
+		cert_signals := make(chan os.Signal, 1)
+		signal.Notify(cert_signals, syscall.SIGHUP)
 		go func() {
-			server := proxy.getTimeoutServer(proxy.bctl.Conf.Proxy.HTTPSAddress, http.HandlerFunc(generic_handler))
-			log.Fatal(server.ListenAndServeTLS(conf.Proxy.CertFile, conf.Proxy.KeyFile))
+			for range cert_signals {
+				cert_store.Reload(true)
+			}
 		}()
+
+		proxy.servers = append(proxy.servers, server)
 	}
 
 	if len(conf.Proxy.Address) != 0 {
 		server := proxy.getTimeoutServer(proxy.bctl.Conf.Proxy.Address, http.HandlerFunc(generic_handler))
-		log.Fatal(server.ListenAndServe())
+		proxy.servers = append(proxy.servers, server)
 	}
+
+	// servers are started only when all of them are registered, since exit request to the admin server
+	// starts shutdown, which walks over all servers
+	for _, server := range proxy.servers {
+		go proxy.serve(server)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	// the first signal starts graceful shutdown (unless it has been started by exit request),
+	// the second one terminates the process immediately
+	sig := <-signals
+	go proxy.shutdown(fmt.Sprintf("received signal %v", sig))
+
+	sig = <-signals
+	log.Printf("shutdown: received signal %v while draining, exiting immediately\n", sig)
+	os.Exit(1)
 }
@@ -0,0 +1,702 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/DemonVex/backrunner/bucket"
+	"github.com/DemonVex/backrunner/config"
+	"github.com/bioothod/elliptics-go/elliptics"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bsim is an offline simulator of the bucket selection model used by the proxy when client doesn't provide bucket name.
+// It loads statistics snapshots (replies of the /stat/ handler) and synthetic backend profiles,
+// runs the same selection code as the proxy for every simulated upload and reports
+// how data and requests spread among buckets and backends.
+
+// snapshot is a saved reply of the /stat/ handler
+type StatAB struct {
+	Address		string
+	Backend		int32
+	Stat		*elliptics.StatBackend
+}
+type GroupStat struct {
+	Backends	[]StatAB
+}
+type BucketStat struct {
+	Group		map[string]GroupStat
+	Meta		bucket.BucketMsgpack
+}
+type Snapshot struct {
+	Buckets		map[string]BucketStat
+}
+
+// synthetic profile describes buckets which do not exist (yet)
+type ProfileBackend struct {
+	Address		string			`json:"address"`
+	Backend		int32			`json:"backend"`
+	TotalSize	uint64			`json:"total-size"`
+	UsedSize	uint64			`json:"used-size"`
+	RemovedSize	uint64			`json:"removed-size"`
+	Records		uint64			`json:"records"`
+	RO		bool			`json:"ro"`
+
+	// number of useconds needed to write one byte, it is what PID controller is fed with
+	Latency		float64			`json:"latency"`
+
+	// ratio of failed writes
+	ErrorRate	float64			`json:"error-rate"`
+}
+type ProfileBucket struct {
+	Groups		map[string][]ProfileBackend	`json:"groups"`
+}
+type Profile struct {
+	Buckets		map[string]ProfileBucket	`json:"buckets"`
+}
+
+type sim_backend struct {
+	name		string
+
+	// statistics seen by the selection code, they are updated once per stat interval like in the proxy
+	st		*elliptics.StatBackend
+
+	// real state of the backend
+	used		uint64
+	avail		uint64
+	total		uint64
+	records		uint64
+
+	latency		float64
+	error_rate	float64
+
+	writes		uint64
+	bytes		uint64
+	errors		uint64
+
+	hard_limit_time	float64
+	hard_limit_hit	bool
+
+	// simulated time of the last controller update
+	pid_time	float64
+}
+
+func (sb *sim_backend) free_rate() float64 {
+	if sb.total == 0 {
+		return 0
+	}
+
+	return float64(sb.avail) / float64(sb.total)
+}
+
+// pid_update() feeds controller with @e at simulated time @now,
+// controller measures time between updates with wall clock, thus its last update time is shifted
+// so that it sees simulated interval instead of the time simulator spent between updates
+func (sb *sim_backend) pid_update(e float64, now float64) {
+	sb.st.PID.LastTime = time.Now().Add(-time.Duration((now - sb.pid_time) * float64(time.Second)))
+	sb.st.PIDUpdate(e)
+	sb.pid_time = now
+}
+
+func (sb *sim_backend) publish() {
+	sb.st.VFS.BackendUsedSize = sb.used
+	sb.st.VFS.Avail = sb.avail
+	sb.st.VFS.RecordsTotal = sb.records
+}
+
+type sim_bucket struct {
+	b		*bucket.Bucket
+	groups		map[uint32][]*sim_backend
+
+	writes		uint64
+	bytes		uint64
+
+	hard_limit_time	float64
+	hard_limit_hit	bool
+}
+
+func (sbk *sim_bucket) backend(group_id uint32, h uint32) *sim_backend {
+	backends := sbk.groups[group_id]
+	if len(backends) == 0 {
+		return nil
+	}
+
+	return backends[(h ^ (group_id * 2654435761)) % uint32(len(backends))]
+}
+
+func (sbk *sim_bucket) add_backend(group_id uint32, sb *sim_backend) {
+	sg, ok := sbk.b.Group[group_id]
+	if !ok {
+		sg = &elliptics.StatGroup {
+			Ab:	make(map[elliptics.AddressBackend]*elliptics.StatBackend),
+		}
+		sbk.b.Group[group_id] = sg
+	}
+
+	// address+backend key is only used to distinguish backends within the group
+	ab := elliptics.AddressBackend {
+		Backend:	int32(len(sbk.groups[group_id])),
+	}
+	sg.Ab[ab] = sb.st
+
+	sbk.groups[group_id] = append(sbk.groups[group_id], sb)
+}
+
+func new_sim_bucket(name string, groups []uint32) *sim_bucket {
+	b := bucket.NewBucket(name)
+	b.Meta = *bucket.NewBucketMsgpack(name)
+	b.Meta.Groups = groups
+
+	return &sim_bucket {
+		b:		b,
+		groups:		make(map[uint32][]*sim_backend),
+	}
+}
+
+func parse_group(group string) uint32 {
+	g, err := strconv.ParseUint(group, 0, 32)
+	if err != nil {
+		log.Fatalf("Invalid group '%s': %v", group, err)
+	}
+
+	return uint32(g)
+}
+
+func load_snapshot(file string, latency float64, buckets map[string]*sim_bucket) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatalf("Could not read statistics snapshot %s: %v", file, err)
+	}
+
+	var snap Snapshot
+	err = json.Unmarshal(data, &snap)
+	if err != nil {
+		log.Fatalf("Could not parse statistics snapshot %s: %v", file, err)
+	}
+
+	for bname, bs := range snap.Buckets {
+		sbk := new_sim_bucket(bname, bs.Meta.Groups)
+
+		for group, gs := range bs.Group {
+			group_id := parse_group(group)
+
+			for _, ab := range gs.Backends {
+				if ab.Stat == nil {
+					continue
+				}
+
+				sb := &sim_backend {
+					name:		fmt.Sprintf("%s/%d", ab.Address, ab.Backend),
+					st:		ab.Stat,
+					used:		ab.Stat.VFS.BackendUsedSize,
+					avail:		ab.Stat.VFS.Avail,
+					total:		ab.Stat.VFS.TotalSizeLimit,
+					records:	ab.Stat.VFS.RecordsTotal,
+					latency:	latency,
+				}
+
+				// free space is limited by the backend size limit, not by the disk size
+				if sb.avail > sb.total {
+					sb.avail = 0
+					if sb.used < sb.total {
+						sb.avail = sb.total - sb.used
+					}
+				}
+
+				sbk.add_backend(group_id, sb)
+			}
+		}
+
+		buckets[bname] = sbk
+	}
+}
+
+func load_profile(file string, buckets map[string]*sim_bucket) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatalf("Could not read backend profile %s: %v", file, err)
+	}
+
+	var prof Profile
+	err = json.Unmarshal(data, &prof)
+	if err != nil {
+		log.Fatalf("Could not parse backend profile %s: %v", file, err)
+	}
+
+	for bname, pb := range prof.Buckets {
+		groups := make([]uint32, 0, len(pb.Groups))
+		for group := range pb.Groups {
+			groups = append(groups, parse_group(group))
+		}
+
+		sbk := new_sim_bucket(bname, groups)
+
+		for group, backends := range pb.Groups {
+			group_id := parse_group(group)
+
+			for _, pback := range backends {
+				if pback.UsedSize > pback.TotalSize {
+					log.Fatalf("bucket: %s, group: %d, backend: %s/%d: used size %d is more than total size %d",
+						bname, group_id, pback.Address, pback.Backend, pback.UsedSize, pback.TotalSize)
+				}
+
+				st := &elliptics.StatBackend {}
+				st.RO = pback.RO
+				st.VFS.Total = pback.TotalSize
+				st.VFS.TotalSizeLimit = pback.TotalSize
+				st.VFS.BackendRemovedSize = pback.RemovedSize
+
+				sb := &sim_backend {
+					name:		fmt.Sprintf("%s/%d", pback.Address, pback.Backend),
+					st:		st,
+					used:		pback.UsedSize,
+					avail:		pback.TotalSize - pback.UsedSize,
+					total:		pback.TotalSize,
+					records:	pback.Records,
+					latency:	pback.Latency,
+					error_rate:	pback.ErrorRate,
+				}
+				sb.publish()
+
+				sbk.add_backend(group_id, sb)
+			}
+		}
+
+		buckets[bname] = sbk
+	}
+}
+
+type size_weight struct {
+	size		uint64
+	weight		float64
+}
+
+type size_distribution struct {
+	sizes		[]size_weight
+	total		float64
+}
+
+// format: 'size:weight,size:weight,...', weight can be omitted and defaults to 1
+func parse_sizes(str string) *size_distribution {
+	dist := &size_distribution {}
+
+	for _, sw := range strings.Split(str, ",") {
+		parts := strings.SplitN(strings.TrimSpace(sw), ":", 2)
+
+		size, err := strconv.ParseUint(parts[0], 0, 64)
+		if err != nil || size == 0 {
+			log.Fatalf("Invalid request size '%s' in size distribution '%s'", parts[0], str)
+		}
+
+		weight := 1.0
+		if len(parts) == 2 {
+			weight, err = strconv.ParseFloat(parts[1], 64)
+			if err != nil || weight <= 0 {
+				log.Fatalf("Invalid weight '%s' in size distribution '%s'", parts[1], str)
+			}
+		}
+
+		dist.sizes = append(dist.sizes, size_weight{size, weight})
+		dist.total += weight
+	}
+
+	return dist
+}
+
+func (dist *size_distribution) pick() uint64 {
+	r := rand.Float64() * dist.total
+	for _, sw := range dist.sizes {
+		r -= sw.weight
+		if r <= 0 {
+			return sw.size
+		}
+	}
+
+	return dist.sizes[len(dist.sizes) - 1].size
+}
+
+type BackendReport struct {
+	Group		uint32
+	Writes		uint64
+	Bytes		uint64
+	Errors		uint64
+	WriteShare	float64
+	ByteShare	float64
+	FreeRate	float64
+	HardLimitTime	*float64		`json:",omitempty"`
+}
+
+type BucketReport struct {
+	Writes		uint64
+	Bytes		uint64
+	WriteShare	float64
+	ByteShare	float64
+	HardLimitTime	*float64		`json:",omitempty"`
+	Backends	map[string]*BackendReport
+}
+
+type FillPoint struct {
+	MinFreeRate	float64
+	AvgFreeRate	float64
+}
+
+type FillSample struct {
+	Time		float64
+	Uploads		int
+	Buckets		map[string]FillPoint
+}
+
+type Report struct {
+	Uploads		int
+	Failed		uint64
+	SimulatedTime	float64
+	Buckets		map[string]*BucketReport
+	Fill		[]FillSample
+}
+
+func fill_sample(now float64, uploads int, buckets map[string]*sim_bucket) FillSample {
+	sample := FillSample {
+		Time:		now,
+		Uploads:	uploads,
+		Buckets:	make(map[string]FillPoint),
+	}
+
+	for name, sbk := range buckets {
+		fp := FillPoint {
+			MinFreeRate:	1.0,
+		}
+
+		num := 0
+		for _, backends := range sbk.groups {
+			for _, sb := range backends {
+				rate := sb.free_rate()
+				if rate < fp.MinFreeRate {
+					fp.MinFreeRate = rate
+				}
+
+				fp.AvgFreeRate += rate
+				num++
+			}
+		}
+
+		if num != 0 {
+			fp.AvgFreeRate /= float64(num)
+		}
+
+		sample.Buckets[name] = fp
+	}
+
+	return sample
+}
+
+func main() {
+	var snapshots, profiles stringslice
+	flag.Var(&snapshots, "stat", "statistics snapshot (saved reply of the /stat/ handler), can be specified multiple times")
+	flag.Var(&profiles, "profile", "synthetic backend profile file, can be specified multiple times")
+	config_file := flag.String("config", "", "proxy config file, free space ratios and stat update interval are read from it")
+	output := flag.String("output", "/dev/stdout", "report file")
+
+	uploads := flag.Int("uploads", 1000000, "number of simulated uploads")
+	rps := flag.Float64("rps", 1000, "simulated upload requests per second")
+	sizes := flag.String("sizes", "1048576", "request size distribution: 'size:weight,size:weight,...'")
+	latency := flag.Float64("latency", 0.01, "write latency in useconds per byte for backends loaded from statistics snapshots")
+	jitter := flag.Float64("jitter", 0.2, "random write latency deviation ratio")
+	stat_interval := flag.Float64("stat-interval", 0, "statistics update interval in simulated seconds, " +
+		"'bucket-stat-update-interval' from proxy config or 5 seconds if not set")
+	report_interval := flag.Float64("report-interval", 60, "fill curve sampling interval in simulated seconds")
+	seed := flag.Int64("seed", 1, "random seed")
+
+	soft := flag.Float64("free-space-ratio-soft", 0, "overrides 'free-space-ratio-soft' proxy config option")
+	hard := flag.Float64("free-space-ratio-hard", 0, "overrides 'free-space-ratio-hard' proxy config option")
+	pain_soft := flag.Float64("pain-no-free-space-soft", 0, "overrides PainNoFreeSpaceSoft")
+	pain_hard := flag.Float64("pain-no-free-space-hard", 0, "overrides PainNoFreeSpaceHard, all penalties derived from it are updated too")
+	pain_discrepancy := flag.Float64("pain-discrepancy", 0, "overrides PainDiscrepancy")
+	flag.Parse()
+
+	if len(snapshots) == 0 && len(profiles) == 0 {
+		log.Fatal("You must specify at least one statistics snapshot or backend profile")
+	}
+
+	conf := &config.ProxyConfig {}
+	if *config_file != "" {
+		err := conf.Load(*config_file)
+		if err != nil {
+			log.Fatalf("Could not load config %s: %v", *config_file, err)
+		}
+	}
+
+	if *soft != 0 {
+		conf.Proxy.FreeSpaceRatioSoft = *soft
+	}
+	if *hard != 0 {
+		conf.Proxy.FreeSpaceRatioHard = *hard
+	}
+
+	// zero ratios disable free space penalties, which is never what proxy runs with
+	if conf.Proxy.FreeSpaceRatioSoft <= 0 || conf.Proxy.FreeSpaceRatioSoft >= 1 ||
+			conf.Proxy.FreeSpaceRatioHard <= 0 || conf.Proxy.FreeSpaceRatioHard >= 1 {
+		log.Fatalf("Free space ratios must be in (0, 1) range, set them in config or with options: soft: %f, hard: %f",
+			conf.Proxy.FreeSpaceRatioSoft, conf.Proxy.FreeSpaceRatioHard)
+	}
+	if conf.Proxy.FreeSpaceRatioSoft < conf.Proxy.FreeSpaceRatioHard {
+		log.Fatalf("Soft free space ratio %f must not be less than hard ratio %f",
+			conf.Proxy.FreeSpaceRatioSoft, conf.Proxy.FreeSpaceRatioHard)
+	}
+	if *stat_interval == 0 {
+		*stat_interval = float64(conf.Proxy.BucketStatUpdateInterval)
+		if *stat_interval == 0 {
+			*stat_interval = 5
+		}
+	}
+
+	params := bucket.NewPainParams(conf.Proxy.FreeSpaceRatioSoft, conf.Proxy.FreeSpaceRatioHard)
+	if *pain_soft != 0 {
+		params.NoFreeSpaceSoft = *pain_soft
+	}
+	if *pain_hard != 0 {
+		params.NoFreeSpaceHard = *pain_hard
+		params.StatRO = *pain_hard / 2
+		params.WriteError = *pain_hard / 2
+		params.NoStats = *pain_hard / 2
+		params.StatError = *pain_hard / 2
+		params.NoGroup = *pain_hard / 2
+	}
+	if *pain_discrepancy != 0 {
+		params.Discrepancy = *pain_discrepancy
+	}
+
+	if *rps <= 0 {
+		log.Fatalf("Invalid simulated request rate %f", *rps)
+	}
+
+	rand.Seed(*seed)
+	dist := parse_sizes(*sizes)
+
+	buckets := make(map[string]*sim_bucket)
+	for _, file := range snapshots {
+		load_snapshot(file, *latency, buckets)
+	}
+	for _, file := range profiles {
+		load_profile(file, buckets)
+	}
+
+	if len(buckets) == 0 {
+		log.Fatal("There are no buckets in snapshots and profiles")
+	}
+
+	// the same order of buckets as in the proxy bucket list, it is needed to make simulation reproducible
+	names := make([]string, 0, len(buckets))
+	for name := range buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	by_bucket := make(map[*bucket.Bucket]*sim_bucket)
+	all := make([]*sim_bucket, 0, len(names))
+	for _, name := range names {
+		sbk := buckets[name]
+		by_bucket[sbk.b] = sbk
+		all = append(all, sbk)
+	}
+
+	report := &Report {
+		Uploads:	*uploads,
+		Buckets:	make(map[string]*BucketReport),
+		Fill:		make([]FillSample, 0),
+	}
+
+	var total_writes, total_bytes uint64
+	next_stat := *stat_interval
+	next_report := 0.0
+	now := 0.0
+
+	for i := 0; i < *uploads; i++ {
+		now = float64(i) / *rps
+
+		if now >= next_stat {
+			for _, sbk := range all {
+				for _, backends := range sbk.groups {
+					for _, sb := range backends {
+						sb.publish()
+					}
+				}
+			}
+
+			next_stat += *stat_interval
+		}
+
+		if now >= next_report {
+			report.Fill = append(report.Fill, fill_sample(now, i, buckets))
+			next_report += *report_interval
+		}
+
+		size := dist.pick()
+		h := rand.Uint32()
+
+		pains := make([]*bucket.BucketPain, 0, len(all))
+		for _, sbk := range all {
+			s := sbk
+			bp := bucket.NewBucketPain(s.b, size, params,
+				func(group_id uint32, sg *elliptics.StatGroup) (*elliptics.StatBackend, error) {
+					sb := s.backend(group_id, h)
+					if sb == nil {
+						return nil, fmt.Errorf("there are no backends in group %d", group_id)
+					}
+
+					return sb.st, nil
+				})
+
+			pains = append(pains, bp)
+		}
+
+		bp := bucket.SelectBucket(bucket.SelectionCandidates(pains, params))
+		if bp == nil {
+			report.Failed++
+			continue
+		}
+
+		sbk := by_bucket[bp.Bucket]
+
+		// the whole upload takes as long as the slowest group write, and every group is fed
+		// with the same per-byte time, this is exactly what bucket upload does in the proxy
+		written := make([]*sim_backend, 0, len(sbk.b.Meta.Groups))
+		time_us := 0.0
+		for _, group_id := range sbk.b.Meta.Groups {
+			sb := sbk.backend(group_id, h)
+			if sb == nil {
+				continue
+			}
+
+			t := sb.latency * float64(size) * (1.0 + *jitter * (2 * rand.Float64() - 1))
+			if t > time_us {
+				time_us = t
+			}
+
+			written = append(written, sb)
+		}
+
+		e := time_us / float64(size)
+		success := false
+		for _, sb := range written {
+			if sb.avail < size || rand.Float64() < sb.error_rate || sb.st.RO {
+				sb.errors++
+				sb.pid_update(params.WriteError, now)
+				continue
+			}
+
+			sb.pid_update(e, now)
+
+			sb.used += size
+			sb.avail -= size
+			sb.records++
+			sb.writes++
+			sb.bytes += size
+			success = true
+
+			if !sb.hard_limit_hit && sb.free_rate() <= conf.Proxy.FreeSpaceRatioHard {
+				sb.hard_limit_hit = true
+				sb.hard_limit_time = now
+			}
+
+			if !sbk.hard_limit_hit && sb.hard_limit_hit {
+				sbk.hard_limit_hit = true
+				sbk.hard_limit_time = now
+			}
+		}
+
+		if success {
+			sbk.writes++
+			sbk.bytes += size
+			total_writes++
+			total_bytes += size
+		} else {
+			report.Failed++
+		}
+	}
+
+	report.SimulatedTime = now
+	report.Fill = append(report.Fill, fill_sample(now, *uploads, buckets))
+
+	share := func(part, total uint64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(part) / float64(total)
+	}
+
+	var total_backend_writes, total_backend_bytes uint64
+	for _, sbk := range all {
+		for _, backends := range sbk.groups {
+			for _, sb := range backends {
+				total_backend_writes += sb.writes
+				total_backend_bytes += sb.bytes
+			}
+		}
+	}
+
+	for _, name := range names {
+		sbk := buckets[name]
+		br := &BucketReport {
+			Writes:		sbk.writes,
+			Bytes:		sbk.bytes,
+			WriteShare:	share(sbk.writes, total_writes),
+			ByteShare:	share(sbk.bytes, total_bytes),
+			Backends:	make(map[string]*BackendReport),
+		}
+
+		if sbk.hard_limit_hit {
+			t := sbk.hard_limit_time
+			br.HardLimitTime = &t
+		}
+
+		for group_id, backends := range sbk.groups {
+			for _, sb := range backends {
+				back := &BackendReport {
+					Group:		group_id,
+					Writes:		sb.writes,
+					Bytes:		sb.bytes,
+					Errors:		sb.errors,
+					WriteShare:	share(sb.writes, total_backend_writes),
+					ByteShare:	share(sb.bytes, total_backend_bytes),
+					FreeRate:	sb.free_rate(),
+				}
+
+				if sb.hard_limit_hit {
+					t := sb.hard_limit_time
+					back.HardLimitTime = &t
+				}
+
+				br.Backends[fmt.Sprintf("%d:%s", group_id, sb.name)] = back
+			}
+		}
+
+		report.Buckets[name] = br
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalf("Could not marshal report: %v", err)
+	}
+
+	err = ioutil.WriteFile(*output, data, 0644)
+	if err != nil {
+		log.Fatalf("Could not write report into %s: %v", *output, err)
+	}
+}
+
+type stringslice []string
+
+func (str *stringslice) String() string {
+	return strings.Join(*str, ",")
+}
+
+func (str *stringslice) Set(value string) error {
+	*str = append(*str, value)
+	return nil
+}
@@ -385,7 +385,7 @@ func (t *BackrunnerTest) ACLInit() error {
 func test_acl(t *BackrunnerTest) error {
 	for _, req := range t.acl_requests {
 		// first, upload acl test key using Elliptics API to be able to run /get/ tests
-		s, err := t.ell.DataSession(req.request)
+		s, err := t.ell.DataSession(req.request.Context(), req.request)
 		if err != nil {
 			return fmt.Errorf("url: %s: could not create data session: %v", req.request.URL.String(), err)
 		}
@@ -913,6 +913,56 @@ func (st *Stat) total_operations(bname, command string) uint64 {
 	return operations
 }
 
+func test_select_explain(t *BackrunnerTest) error {
+	req := t.NewEmptyRequest("GET", "select_explain/", "", "", "", "")
+
+	q := req.URL.Query()
+	q.Set("key", strconv.FormatInt(rand.Int63(), 16))
+	q.Set("size", "1024")
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("select-explain: url: %s: could not send request: %v", req.URL.String(), err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("select-explain: url: %s: could not read reply: %v", req.URL.String(), err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("select-explain: url: %s, returned status: %d, must be: %d, data: %s",
+			req.URL.String(), resp.StatusCode, http.StatusOK, string(data))
+	}
+
+	var explain bucket.SelectExplain
+	err = json.Unmarshal(data, &explain)
+	if err != nil {
+		return fmt.Errorf("select-explain: could not parse reply '%s': %v", string(data), err)
+	}
+
+	if explain.Candidates == 0 || len(explain.Buckets) < explain.Candidates {
+		return fmt.Errorf("select-explain: invalid reply '%s': candidates: %d, buckets: %d",
+			string(data), explain.Candidates, len(explain.Buckets))
+	}
+
+	probability := 0.0
+	for _, bp := range explain.Buckets {
+		if len(bp.Excluded) == 0 {
+			probability += bp.Probability
+		}
+	}
+
+	if probability < 0.99 || probability > 1.01 {
+		return fmt.Errorf("select-explain: invalid reply '%s': sum of probabilities: %f, must be 1",
+			string(data), probability)
+	}
+
+	return nil
+}
+
 func test_stats_update(t *BackrunnerTest) error {
 	// sleep for bucket statistics to settle from previous tests, it is periodic
 	time.Sleep(6 * time.Second)
@@ -1174,6 +1224,7 @@ var tests = [](func(t *BackrunnerTest) error) {
 	test_bucket_file_update,
 	test_backend_slowdown,
 	test_nobucket_upload,
+	test_select_explain,
 	test_small_bucket_upload,
 	test_big_bucket_upload,
 	test_acl,